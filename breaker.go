@@ -0,0 +1,178 @@
+package vkutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrCircuitOpen is returned instead of sending commands or dialing while a circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WithCircuitBreaker configures a circuit breaker which opens after the given number of consecutive connection failures
+// or timeouts. While open, commands and dials fail immediately with ErrCircuitOpen. Once the cooldown has passed, a
+// single command is allowed through to probe the server, and if that succeeds the breaker closes again. A threshold
+// less than 1 is treated as 1.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) PoolOption {
+	return func(c *poolConfig) { c.breaker = &circuitBreaker{threshold: max(threshold, 1), cooldown: cooldown} }
+}
+
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	failures int       // number of consecutive failures
+	openedAt time.Time // when we last failed while open
+	probing  bool      // whether a probe is in progress
+}
+
+// checks whether a new connection can be dialed
+func (b *circuitBreaker) check() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures >= b.threshold && time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// checks whether a command can be sent, and if so whether it's a probe
+func (b *circuitBreaker) allow() (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return false, nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false, ErrCircuitOpen
+	}
+
+	b.probing = true
+	return true, nil
+}
+
+func (b *circuitBreaker) record(probe, failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	if failed {
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = time.Now()
+		}
+	} else {
+		b.failures = 0
+	}
+}
+
+func (b *circuitBreaker) abandon(probe bool) {
+	if probe {
+		b.mutex.Lock()
+		b.probing = false
+		b.mutex.Unlock()
+	}
+}
+
+// wraps the given dial function so that dials and connections are guarded by the circuit breaker, if configured
+func (c *poolConfig) breaking(dial func(context.Context) (redis.Conn, error)) func(context.Context) (redis.Conn, error) {
+	b := c.breaker
+	if b == nil {
+		return dial
+	}
+
+	return func(ctx context.Context) (redis.Conn, error) {
+		if err := b.check(); err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx)
+		if err != nil {
+			if isConnectionFailure(nil, err) {
+				b.record(false, true)
+			}
+			return nil, err
+		}
+		return &breakerConn{Conn: conn, breaker: b}, nil
+	}
+}
+
+// breakerConn is a connection which records the outcome of each command with a circuit breaker
+type breakerConn struct {
+	redis.Conn
+
+	breaker *circuitBreaker
+	err     error
+}
+
+func (c *breakerConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+func (c *breakerConn) Do(cmd string, args ...any) (any, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *breakerConn) DoContext(ctx context.Context, cmd string, args ...any) (any, error) {
+	return c.do(ctx, redis.DoContext, cmd, args...)
+}
+
+func (c *breakerConn) DoWithTimeout(timeout time.Duration, cmd string, args ...any) (any, error) {
+	return c.do(context.Background(), doWithTimeout(timeout), cmd, args...)
+}
+
+func (c *breakerConn) do(ctx context.Context, do doFunc, cmd string, args ...any) (any, error) {
+	if cmd == "" {
+		return do(c.Conn, ctx, cmd, args...) // just flushing pending commands
+	}
+
+	probe, err := c.breaker.allow()
+	if err != nil {
+		c.err = err // connection may have pending commands so mustn't be reused
+		return nil, err
+	}
+
+	reply, err := do(c.Conn, ctx, cmd, args...)
+
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		c.breaker.abandon(probe) // caller gave up so we don't know if the server is healthy
+	} else {
+		timedOut := err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		c.breaker.record(probe, timedOut || isConnectionFailure(c.Conn, err))
+	}
+	return reply, err
+}
+
+func (c *breakerConn) ReceiveContext(ctx context.Context) (any, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func (c *breakerConn) ReceiveWithTimeout(timeout time.Duration) (any, error) {
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+// checks whether the given error means that we couldn't talk to the server, rather than it replying with an error
+func isConnectionFailure(conn redis.Conn, err error) bool {
+	if err == nil {
+		return false
+	}
+	if conn != nil && conn.Err() != nil {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,101 @@
+package vkutil_test
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	// fake server which can be made to stop replying in time
+	var slow atomic.Bool
+	var received atomic.Int32
+
+	server := fakeServer(t, func(args []string) string {
+		if strings.ToUpper(args[0]) != "PING" {
+			received.Add(1)
+		}
+		if slow.Load() {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if strings.ToUpper(args[0]) == "INCR" {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		return "+OK\r\n"
+	})
+
+	rp, err := vkutil.NewPool("redis://"+server, vkutil.WithReadTimeout(20*time.Millisecond), vkutil.WithCircuitBreaker(2, 200*time.Millisecond))
+	require.NoError(t, err)
+
+	doWithContext := func(ctx context.Context, cmd string) error {
+		rc := rp.Get()
+		defer rc.Close()
+
+		_, err := redis.DoContext(rc, ctx, cmd, "foo")
+		return err
+	}
+	do := func(cmd string) error { return doWithContext(ctx, cmd) }
+
+	// error replies don't count as failures
+	assert.EqualError(t, do("INCR"), "ERR value is not an integer or out of range")
+	assert.EqualError(t, do("INCR"), "ERR value is not an integer or out of range")
+	assert.NoError(t, do("SET"))
+
+	// timeouts do, and the breaker opens after 2 of them
+	slow.Store(true)
+	assert.ErrorContains(t, do("SET"), "i/o timeout")
+	assert.ErrorContains(t, do("SET"), "i/o timeout")
+
+	received.Store(0)
+
+	// now commands fail fast without being sent
+	assert.ErrorIs(t, do("SET"), vkutil.ErrCircuitOpen)
+	assert.ErrorIs(t, do("SET"), vkutil.ErrCircuitOpen)
+	assert.Equal(t, int32(0), received.Load())
+
+	// once the cooldown has passed, a probe is let through, which fails and reopens the breaker
+	time.Sleep(250 * time.Millisecond)
+
+	assert.ErrorContains(t, do("SET"), "i/o timeout")
+	assert.ErrorIs(t, do("SET"), vkutil.ErrCircuitOpen)
+	assert.Equal(t, int32(1), received.Load())
+
+	// server recovers and the next probe succeeds, which closes the breaker
+	slow.Store(false)
+	time.Sleep(250 * time.Millisecond)
+
+	assert.NoError(t, do("SET"))
+	assert.NoError(t, do("SET"))
+	assert.Equal(t, int32(3), received.Load())
+
+	// commands can also be sent with timeouts
+	rc := rp.Get()
+	_, err = redis.DoWithTimeout(rc, time.Second, "SET", "foo")
+	assert.NoError(t, err)
+	rc.Close()
+
+	// threshold is at least 1, and a context deadline counts as a failure
+	rp, err = vkutil.NewPool("redis://"+server, vkutil.WithCircuitBreaker(0, time.Minute))
+	require.NoError(t, err)
+
+	slow.Store(true)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	assert.ErrorIs(t, doWithContext(cancelCtx, "SET"), context.Canceled)
+	assert.NoError(t, do("SET")) // but the caller giving up doesn't
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, doWithContext(timeoutCtx, "SET"), "i/o timeout")
+	assert.ErrorIs(t, do("SET"), vkutil.ErrCircuitOpen)
+}
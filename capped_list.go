@@ -0,0 +1,64 @@
+package vkutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// CappedList is a list but enforces a cap on size by only retaining the most recently pushed items
+type CappedList struct {
+	key    string
+	cap    int
+	expire time.Duration
+}
+
+// NewCappedList creates a new capped list. A cap less than 1 means that no items are retained.
+func NewCappedList(key string, cap int, expire time.Duration) *CappedList {
+	return &CappedList{key: key, cap: cap, expire: expire}
+}
+
+// Push adds the given values to the front of the list, removing the oldest items if that takes it over its cap
+func (l *CappedList) Push(ctx context.Context, rc redis.Conn, values ...string) error {
+	ctx = withOperation(ctx, "CappedList.Push", false)
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	// LTRIM can't trim to nothing as a stop index of -1 means the end of the list
+	if l.cap < 1 {
+		_, err := redis.DoContext(rc, ctx, "DEL", l.key)
+		return err
+	}
+
+	rc.Send("MULTI")
+	rc.Send("LPUSH", redis.Args{}.Add(l.key).AddFlat(values)...)
+	rc.Send("LTRIM", l.key, 0, l.cap-1)
+	rc.Send("EXPIRE", l.key, int(l.expire/time.Second))
+	_, err := redis.DoContext(rc, ctx, "EXEC")
+	return err
+}
+
+// Len returns the length of the list
+func (l *CappedList) Len(ctx context.Context, rc redis.Conn) (int, error) {
+	ctx = withOperation(ctx, "CappedList.Len", true)
+
+	return redis.Int(redis.DoContext(rc, ctx, "LLEN", l.key))
+}
+
+// Items returns all items in the list, newest first
+func (l *CappedList) Items(ctx context.Context, rc redis.Conn) ([]string, error) {
+	ctx = withOperation(ctx, "CappedList.Items", true)
+
+	return l.Range(ctx, rc, 0, -1)
+}
+
+// Range returns the items between the start and stop indexes inclusive, newest first. Negative indexes are offsets
+// from the end of the list.
+func (l *CappedList) Range(ctx context.Context, rc redis.Conn, start, stop int) ([]string, error) {
+	ctx = withOperation(ctx, "CappedList.Range", true)
+
+	return redis.Strings(redis.DoContext(rc, ctx, "LRANGE", l.key, start, stop))
+}
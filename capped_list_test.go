@@ -0,0 +1,65 @@
+package vkutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCappedList(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	assertItems := func(l *vkutil.CappedList, expected []string) {
+		actual, err := l.Items(ctx, rc)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	list := vkutil.NewCappedList("foo", 3, time.Minute*5)
+	assertItems(list, []string{})
+
+	assert.NoError(t, list.Push(ctx, rc, "A"))
+	assert.NoError(t, list.Push(ctx, rc, "B", "C"))
+	assert.NoError(t, list.Push(ctx, rc))
+
+	assertvk.LGetAll(t, rc, "foo", []string{"C", "B", "A"})
+	assertItems(list, []string{"C", "B", "A"})
+
+	// pushing more items pushes out the oldest
+	assert.NoError(t, list.Push(ctx, rc, "D"))
+
+	assertItems(list, []string{"D", "C", "B"})
+
+	assert.NoError(t, list.Push(ctx, rc, "E", "F", "G", "H"))
+
+	assertItems(list, []string{"H", "G", "F"})
+
+	length, err := list.Len(ctx, rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, length)
+
+	items, err := list.Range(ctx, rc, 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"H", "G"}, items)
+
+	items, err = list.Range(ctx, rc, -1, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"F"}, items)
+	// list with no capacity retains nothing
+	list = vkutil.NewCappedList("bar", 0, time.Minute*5)
+	assert.NoError(t, list.Push(ctx, rc, "A", "B"))
+
+	length, err = list.Len(ctx, rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, length)
+	assertvk.NotExists(t, rc, "bar")
+}
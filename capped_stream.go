@@ -0,0 +1,137 @@
+package vkutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// StreamEntry is an entry read from a stream
+type StreamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// CappedStreamOption is an option passed to NewCappedStream
+type CappedStreamOption func(*CappedStream)
+
+// WithApproximateTrimming configures a capped stream to trim with MAXLEN ~ which is more efficient but may leave
+// the stream a little longer than its cap
+func WithApproximateTrimming() CappedStreamOption {
+	return func(s *CappedStream) { s.approximate = true }
+}
+
+// CappedStream is a stream but enforces a cap on length by only retaining the most recently added entries
+type CappedStream struct {
+	key         string
+	cap         int
+	expire      time.Duration
+	approximate bool
+}
+
+// NewCappedStream creates a new capped stream
+func NewCappedStream(key string, cap int, expire time.Duration, options ...CappedStreamOption) *CappedStream {
+	s := &CappedStream{key: key, cap: cap, expire: expire}
+
+	for _, o := range options {
+		o(s)
+	}
+
+	return s
+}
+
+// Add appends an entry with the given fields to the stream, removing the oldest entries if that takes it over its
+// cap, and returns the ID of the new entry
+func (s *CappedStream) Add(ctx context.Context, rc redis.Conn, fields map[string]string) (string, error) {
+	ctx = withOperation(ctx, "CappedStream.Add", false)
+
+	if len(fields) == 0 {
+		return "", errors.New("stream entries must have at least one field")
+	}
+
+	args := redis.Args{}.Add(s.key, "MAXLEN")
+	if s.approximate {
+		args = args.Add("~")
+	}
+	args = args.Add(s.cap, "*")
+	for _, f := range slices.Sorted(maps.Keys(fields)) {
+		args = args.Add(f, fields[f])
+	}
+
+	rc.Send("MULTI")
+	rc.Send("XADD", args...)
+	rc.Send("EXPIRE", s.key, int(s.expire/time.Second))
+	vals, err := redis.Values(redis.DoContext(rc, ctx, "EXEC"))
+	if err != nil {
+		return "", err
+	}
+
+	return redis.String(vals[0], nil)
+}
+
+// Len returns the length of the stream
+func (s *CappedStream) Len(ctx context.Context, rc redis.Conn) (int, error) {
+	ctx = withOperation(ctx, "CappedStream.Len", true)
+
+	return redis.Int(redis.DoContext(rc, ctx, "XLEN", s.key))
+}
+
+// Range returns entries with IDs between start and end inclusive, oldest first. Use "-" and "+" for the oldest and
+// newest possible IDs, and a count of zero to return all matching entries.
+func (s *CappedStream) Range(ctx context.Context, rc redis.Conn, start, end string, count int) ([]StreamEntry, error) {
+	ctx = withOperation(ctx, "CappedStream.Range", true)
+
+	args := redis.Args{}.Add(s.key, start, end)
+	if count > 0 {
+		args = args.Add("COUNT", count)
+	}
+
+	return streamEntries(redis.DoContext(rc, ctx, "XRANGE", args...))
+}
+
+// Latest returns the n most recently added entries, newest first
+func (s *CappedStream) Latest(ctx context.Context, rc redis.Conn, n int) ([]StreamEntry, error) {
+	ctx = withOperation(ctx, "CappedStream.Latest", true)
+
+	if n <= 0 {
+		return []StreamEntry{}, nil
+	}
+
+	return streamEntries(redis.DoContext(rc, ctx, "XREVRANGE", s.key, "+", "-", "COUNT", n))
+}
+
+// parses an array reply of stream entries, each of which is an ID and an array of alternating fields and values
+func streamEntries(reply any, err error) ([]StreamEntry, error) {
+	vals, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]StreamEntry, len(vals))
+	for i, v := range vals {
+		parts, err := redis.Values(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry with %d parts", len(parts))
+		}
+
+		id, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := redis.StringMap(parts[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = StreamEntry{ID: id, Fields: fields}
+	}
+	return entries, nil
+}
@@ -0,0 +1,88 @@
+package vkutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCappedStream(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	fieldsOf := func(entries []vkutil.StreamEntry) []map[string]string {
+		fields := make([]map[string]string, len(entries))
+		for i := range entries {
+			fields[i] = entries[i].Fields
+		}
+		return fields
+	}
+
+	stream := vkutil.NewCappedStream("foo", 3, time.Minute*5)
+
+	entries, err := stream.Range(ctx, rc, "-", "+", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []vkutil.StreamEntry{}, entries)
+
+	id1, err := stream.Add(ctx, rc, map[string]string{"type": "A", "value": "1"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id1)
+
+	for _, v := range []string{"B", "C", "D"} {
+		_, err := stream.Add(ctx, rc, map[string]string{"type": v})
+		require.NoError(t, err)
+	}
+
+	assertvk.Exists(t, rc, "foo")
+
+	length, err := stream.Len(ctx, rc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, length)
+
+	// oldest entry has been trimmed
+	entries, err = stream.Range(ctx, rc, "-", "+", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"type": "B"}, {"type": "C"}, {"type": "D"}}, fieldsOf(entries))
+	assert.NotEqual(t, id1, entries[0].ID)
+
+	entries, err = stream.Range(ctx, rc, "-", "+", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"type": "B"}, {"type": "C"}}, fieldsOf(entries))
+
+	last := entries[1].ID
+	entries, err = stream.Range(ctx, rc, last, "+", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"type": "C"}, {"type": "D"}}, fieldsOf(entries))
+
+	entries, err = stream.Latest(ctx, rc, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"type": "D"}, {"type": "C"}}, fieldsOf(entries))
+
+	entries, err = stream.Latest(ctx, rc, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []vkutil.StreamEntry{}, entries)
+
+	_, err = stream.Add(ctx, rc, map[string]string{})
+	assert.EqualError(t, err, "stream entries must have at least one field")
+
+	// approximate trimming may leave the stream a little longer than its cap
+	stream = vkutil.NewCappedStream("bar", 3, time.Minute*5, vkutil.WithApproximateTrimming())
+
+	for _, v := range []string{"A", "B", "C", "D", "E"} {
+		_, err := stream.Add(ctx, rc, map[string]string{"type": v})
+		require.NoError(t, err)
+	}
+
+	length, err = stream.Len(ctx, rc)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, length, 3)
+}
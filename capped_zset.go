@@ -3,39 +3,199 @@ package vkutil
 import (
 	"context"
 	_ "embed"
+	"fmt"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+// Eviction is the policy used to decide which members are removed when a CappedZSet exceeds its cap
+type Eviction string
+
+// possible eviction policies
+const (
+	EvictLowest  Eviction = "lowest"  // keeps the highest scoring members
+	EvictHighest Eviction = "highest" // keeps the lowest scoring members
+	EvictOldest  Eviction = "oldest"  // keeps the most recently added members regardless of score
+)
+
+// CappedZSetOption is an option passed to NewCappedZSet
+type CappedZSetOption func(*CappedZSet)
+
+// WithEviction configures which members are removed when the set exceeds its cap (default is EvictLowest)
+func WithEviction(e Eviction) CappedZSetOption {
+	return func(z *CappedZSet) { z.eviction = e }
+}
+
 // CappedZSet is a sorted set but enforces a cap on size
 type CappedZSet struct {
-	key    string
-	cap    int
-	expire time.Duration
+	key      string
+	cap      int
+	expire   time.Duration
+	eviction Eviction
 }
 
 // NewCappedZSet creates a new capped sorted set
-func NewCappedZSet(key string, cap int, expire time.Duration) *CappedZSet {
-	return &CappedZSet{key: key, cap: cap, expire: expire}
+func NewCappedZSet(key string, cap int, expire time.Duration, options ...CappedZSetOption) *CappedZSet {
+	z := &CappedZSet{key: key, cap: cap, expire: expire, eviction: EvictLowest}
+
+	for _, o := range options {
+		o(z)
+	}
+
+	return z
 }
 
 //go:embed lua/czset_add.lua
 var czsetAdd string
-var czsetAddScript = redis.NewScript(1, czsetAdd)
+var czsetAddScript = redis.NewScript(2, czsetAdd)
+
+// Add adds an element to the set, evicting other members if that takes it over its cap. Returns whether the added
+// member is still in the set, i.e. it wasn't itself evicted.
+func (z *CappedZSet) Add(ctx context.Context, rc redis.Conn, member string, score float64) (bool, error) {
+	ctx = withOperation(ctx, "CappedZSet.Add", true)
+
+	survived, _, err := z.add(ctx, rc, []string{member}, []float64{score}, false)
+	if err != nil {
+		return false, err
+	}
+	return survived[0], nil
+}
 
-// Add adds an element to the set, if its score puts in the top `cap` members
-func (z *CappedZSet) Add(ctx context.Context, rc redis.Conn, member string, score float64) error {
-	_, err := czsetAddScript.DoContext(ctx, rc, z.key, score, member, z.cap, int(z.expire/time.Second))
+// AddMany adds multiple elements to the set, and then applies the cap once. Returns whether each added member is
+// still in the set.
+func (z *CappedZSet) AddMany(ctx context.Context, rc redis.Conn, members []string, scores []float64) ([]bool, error) {
+	ctx = withOperation(ctx, "CappedZSet.AddMany", true)
+
+	if len(members) != len(scores) {
+		return nil, fmt.Errorf("got %d members but %d scores", len(members), len(scores))
+	}
+	if len(members) == 0 {
+		return []bool{}, nil
+	}
+
+	survived, _, err := z.add(ctx, rc, members, scores, false)
+	return survived, err
+}
+
+// IncrBy increments the score of a member, adding it if it doesn't exist, and then re-applies the cap. Returns
+// whether the member is still in the set and its new score.
+func (z *CappedZSet) IncrBy(ctx context.Context, rc redis.Conn, member string, delta float64) (bool, float64, error) {
+	ctx = withOperation(ctx, "CappedZSet.IncrBy", false)
+
+	survived, scores, err := z.add(ctx, rc, []string{member}, []float64{delta}, true)
+	if err != nil {
+		return false, 0, err
+	}
+	return survived[0], scores[0], nil
+}
+
+func (z *CappedZSet) add(ctx context.Context, rc redis.Conn, members []string, scores []float64, incr bool) ([]bool, []float64, error) {
+	args := redis.Args{}.Add(z.key, z.orderKey(), z.cap, int(z.expire/time.Second), string(z.eviction), incr)
+	for i := range members {
+		args = args.Add(scores[i], members[i])
+	}
+
+	vals, err := redis.Values(czsetAddScript.DoContext(ctx, rc, args...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	survived := make([]bool, len(members))
+	newScores := make([]float64, len(members))
+	for i := range members {
+		if vals, err = redis.Scan(vals, &survived[i], &newScores[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return survived, newScores, nil
+}
+
+// Rem removes the given members
+func (z *CappedZSet) Rem(ctx context.Context, rc redis.Conn, members ...string) error {
+	ctx = withOperation(ctx, "CappedZSet.Rem", true)
+
+	rc.Send("MULTI")
+	rc.Send("ZREM", redis.Args{}.Add(z.key).AddFlat(members)...)
+	if z.eviction == EvictOldest {
+		rc.Send("ZREM", redis.Args{}.Add(z.orderKey()).AddFlat(members)...)
+	}
+	_, err := redis.DoContext(rc, ctx, "EXEC")
 	return err
 }
 
+// Score returns the score of the given member and whether it exists in the set
+func (z *CappedZSet) Score(ctx context.Context, rc redis.Conn, member string) (float64, bool, error) {
+	ctx = withOperation(ctx, "CappedZSet.Score", true)
+
+	score, err := redis.Float64(redis.DoContext(rc, ctx, "ZSCORE", z.key, member))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return score, true, nil
+}
+
+// Rank returns the rank of the given member by ascending score, or -1 if it doesn't exist in the set
+func (z *CappedZSet) Rank(ctx context.Context, rc redis.Conn, member string) (int, error) {
+	ctx = withOperation(ctx, "CappedZSet.Rank", true)
+
+	rank, err := redis.Int(redis.DoContext(rc, ctx, "ZRANK", z.key, member))
+	if err == redis.ErrNil {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rank, nil
+}
+
 // Card returns the cardinality of the set
 func (z *CappedZSet) Card(ctx context.Context, rc redis.Conn) (int, error) {
+	ctx = withOperation(ctx, "CappedZSet.Card", true)
+
 	return redis.Int(redis.DoContext(rc, ctx, "ZCARD", z.key))
 }
 
 // Members returns all members of the set, ordered by ascending rank
 func (z *CappedZSet) Members(ctx context.Context, rc redis.Conn) ([]string, []float64, error) {
-	return StringsWithScores(redis.DoContext(rc, ctx, "ZRANGE", z.key, 0, -1, "WITHSCORES"))
+	ctx = withOperation(ctx, "CappedZSet.Members", true)
+
+	return StringsWithScores(redis.DoContext(rc, readOnly(ctx), "ZRANGE", z.key, 0, -1, "WITHSCORES"))
+}
+
+// RangeByScore returns members with scores between min and max inclusive, ordered by ascending rank. Results can be
+// paged with offset and count, where a negative count returns all remaining members.
+func (z *CappedZSet) RangeByScore(ctx context.Context, rc redis.Conn, min, max float64, offset, count int) ([]string, []float64, error) {
+	ctx = withOperation(ctx, "CappedZSet.RangeByScore", true)
+
+	return StringsWithScores(redis.DoContext(rc, ctx, "ZRANGEBYSCORE", z.key, min, max, "WITHSCORES", "LIMIT", offset, count))
+}
+
+// Top returns the first n members in the order they are retained, i.e. highest scores first, unless the set keeps
+// the lowest scoring members in which case it's lowest scores first.
+func (z *CappedZSet) Top(ctx context.Context, rc redis.Conn, n int) ([]string, []float64, error) {
+	ctx = withOperation(ctx, "CappedZSet.Top", true)
+
+	if n <= 0 {
+		return []string{}, []float64{}, nil
+	}
+
+	cmd := "ZREVRANGE"
+	if z.eviction == EvictHighest {
+		cmd = "ZRANGE"
+	}
+
+	return StringsWithScores(redis.DoContext(rc, ctx, cmd, z.key, 0, n-1, "WITHSCORES"))
+}
+
+// key of the sorted set used to track insertion order when evicting the oldest members, which uses the set's key as a
+// hash tag, unless it has its own, so that both keys are in the same cluster slot
+func (z *CappedZSet) orderKey() string {
+	if _, ok := hashTag(z.key); ok {
+		return fmt.Sprintf("%s:order", z.key)
+	}
+	return fmt.Sprintf("{%s}:order", z.key)
 }
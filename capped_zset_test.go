@@ -2,6 +2,8 @@ package vkutil_test
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"testing"
 	"time"
 
@@ -18,6 +20,11 @@ func TestCappedZSet(t *testing.T) {
 
 	defer assertvk.FlushDB()
 
+	assertAdd := func(s *vkutil.CappedZSet, member string, score float64, expected bool) {
+		actual, err := s.Add(ctx, rc, member, score)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "survived mismatch adding %s", member)
+	}
 	assertMembers := func(s *vkutil.CappedZSet, expectedMembers []string, expectedScores []float64) {
 		actualMembers, actualScores, err := s.Members(ctx, rc)
 		assert.NoError(t, err)
@@ -26,9 +33,9 @@ func TestCappedZSet(t *testing.T) {
 	}
 
 	zset := vkutil.NewCappedZSet("foo", 3, time.Minute*5)
-	assert.NoError(t, zset.Add(ctx, rc, "A", 1))
-	assert.NoError(t, zset.Add(ctx, rc, "C", 3))
-	assert.NoError(t, zset.Add(ctx, rc, "B", 2))
+	assertAdd(zset, "A", 1, true)
+	assertAdd(zset, "C", 3, true)
+	assertAdd(zset, "B", 2, true)
 
 	assertvk.ZGetAll(t, rc, "foo", map[string]float64{"A": 1, "B": 2, "C": 3})
 
@@ -39,27 +46,222 @@ func TestCappedZSet(t *testing.T) {
 	assertMembers(zset, []string{"A", "B", "C"}, []float64{1, 2, 3})
 
 	// adding a new member with a higher score, pushes out the lowest scoring element
-	zset.Add(ctx, rc, "D", 4)
+	assertAdd(zset, "D", 4, true)
 
 	assertMembers(zset, []string{"B", "C", "D"}, []float64{2, 3, 4})
 
 	// adding a new member with a non-unique score still maintains the cap
-	zset.Add(ctx, rc, "E", 4)
+	assertAdd(zset, "E", 4, true)
 
 	assertMembers(zset, []string{"C", "D", "E"}, []float64{3, 4, 4})
 
 	// adding a new member with a score that's too low is a noop
-	zset.Add(ctx, rc, "F", 2)
+	assertAdd(zset, "F", 2, false)
 
 	assertMembers(zset, []string{"C", "D", "E"}, []float64{3, 4, 4})
 
 	// order is always based on score rather than lex
-	zset.Add(ctx, rc, "G", 3.5)
+	assertAdd(zset, "G", 3.5, true)
 
 	assertMembers(zset, []string{"G", "D", "E"}, []float64{3.5, 4, 4})
 
 	// re-adding a member updates the score
-	zset.Add(ctx, rc, "D", 4.5)
+	assertAdd(zset, "D", 4.5, true)
 
 	assertMembers(zset, []string{"G", "E", "D"}, []float64{3.5, 4, 4.5})
+
+	assertvk.NotExists(t, rc, "{foo}:order")
+
+	// a set which keeps the lowest scores
+	zset = vkutil.NewCappedZSet("bar", 3, time.Minute*5, vkutil.WithEviction(vkutil.EvictHighest))
+	assertAdd(zset, "A", 1, true)
+	assertAdd(zset, "C", 3, true)
+	assertAdd(zset, "B", 2, true)
+	assertAdd(zset, "D", 4, false)
+
+	assertMembers(zset, []string{"A", "B", "C"}, []float64{1, 2, 3})
+
+	assertAdd(zset, "E", 0.5, true)
+
+	assertMembers(zset, []string{"E", "A", "B"}, []float64{0.5, 1, 2})
+
+	// a set which keeps the most recently added regardless of score
+	zset = vkutil.NewCappedZSet("baz", 3, time.Minute*5, vkutil.WithEviction(vkutil.EvictOldest))
+	assertAdd(zset, "A", 3, true)
+	assertAdd(zset, "B", 1, true)
+	assertAdd(zset, "C", 2, true)
+	assertAdd(zset, "D", 0, true)
+
+	assertMembers(zset, []string{"D", "B", "C"}, []float64{0, 1, 2})
+	assertvk.ZGetAll(t, rc, "{baz}:order", map[string]float64{"B": 2, "C": 3, "D": 4})
+
+	// re-adding a member makes it the most recent
+	assertAdd(zset, "B", 5, true)
+	assertAdd(zset, "E", 4, true)
+
+	assertMembers(zset, []string{"D", "E", "B"}, []float64{0, 4, 5})
+	assertvk.ZGetAll(t, rc, "{baz}:order", map[string]float64{"D": 4, "B": 5, "E": 6})
+	// insertion order is tracked in the same cluster slot as the set, using its hash tag if it has one
+	assert.Equal(t, vkutil.KeySlot("baz"), vkutil.KeySlot("{baz}:order"))
+
+	zset = vkutil.NewCappedZSet("{qux}:2021", 3, time.Minute*5, vkutil.WithEviction(vkutil.EvictOldest))
+	assertAdd(zset, "A", 1, true)
+
+	assertvk.ZGetAll(t, rc, "{qux}:2021:order", map[string]float64{"A": 1})
+}
+
+func TestCappedZSetQueries(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	assertMembers := func(s *vkutil.CappedZSet, expectedMembers []string, expectedScores []float64) {
+		actualMembers, actualScores, err := s.Members(ctx, rc)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedMembers, actualMembers)
+		assert.Equal(t, expectedScores, actualScores)
+	}
+	assertScore := func(s *vkutil.CappedZSet, member string, expectedScore float64, expectedExists bool) {
+		actualScore, actualExists, err := s.Score(ctx, rc, member)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedScore, actualScore, "score mismatch for %s", member)
+		assert.Equal(t, expectedExists, actualExists, "exists mismatch for %s", member)
+	}
+	assertRank := func(s *vkutil.CappedZSet, member string, expected int) {
+		actual, err := s.Rank(ctx, rc, member)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "rank mismatch for %s", member)
+	}
+	assertIncrBy := func(s *vkutil.CappedZSet, member string, delta float64, expectedSurvived bool, expectedScore float64) {
+		actualSurvived, actualScore, err := s.IncrBy(ctx, rc, member, delta)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedSurvived, actualSurvived, "survived mismatch for %s", member)
+		assert.Equal(t, expectedScore, actualScore, "score mismatch for %s", member)
+	}
+	assertRange := func(members []string, scores []float64, err error, expectedMembers []string, expectedScores []float64) {
+		assert.NoError(t, err)
+		assert.Equal(t, expectedMembers, members)
+		assert.Equal(t, expectedScores, scores)
+	}
+
+	zset := vkutil.NewCappedZSet("foo", 4, time.Minute*5)
+	zset.Add(ctx, rc, "A", 1)
+	zset.Add(ctx, rc, "B", 2)
+	zset.Add(ctx, rc, "C", 3)
+	zset.Add(ctx, rc, "D", 4)
+
+	assertScore(zset, "B", 2, true)
+	assertScore(zset, "X", 0, false)
+	assertRank(zset, "A", 0)
+	assertRank(zset, "D", 3)
+	assertRank(zset, "X", -1)
+
+	// incrementing re-orders members
+	assertIncrBy(zset, "A", 2.5, true, 3.5)
+
+	assertMembers(zset, []string{"B", "C", "A", "D"}, []float64{2, 3, 3.5, 4})
+
+	// incrementing a new member adds it and re-applies the cap
+	assertIncrBy(zset, "E", 5, true, 5)
+	assertIncrBy(zset, "F", 1, false, 1)
+
+	assertMembers(zset, []string{"C", "A", "D", "E"}, []float64{3, 3.5, 4, 5})
+
+	members, scores, err := zset.RangeByScore(ctx, rc, 3.5, 5, 0, -1)
+	assertRange(members, scores, err, []string{"A", "D", "E"}, []float64{3.5, 4, 5})
+
+	members, scores, err = zset.RangeByScore(ctx, rc, math.Inf(-1), math.Inf(1), 1, 2)
+	assertRange(members, scores, err, []string{"A", "D"}, []float64{3.5, 4})
+
+	members, scores, err = zset.Top(ctx, rc, 2)
+	assertRange(members, scores, err, []string{"E", "D"}, []float64{5, 4})
+
+	members, scores, err = zset.Top(ctx, rc, 10)
+	assertRange(members, scores, err, []string{"E", "D", "A", "C"}, []float64{5, 4, 3.5, 3})
+
+	members, scores, err = zset.Top(ctx, rc, 0)
+	assertRange(members, scores, err, []string{}, []float64{})
+
+	assert.NoError(t, zset.Rem(ctx, rc, "D", "X", "A"))
+
+	assertMembers(zset, []string{"C", "E"}, []float64{3, 5})
+
+	// top of a set which keeps the lowest scores is the lowest scores
+	zset = vkutil.NewCappedZSet("bar", 3, time.Minute*5, vkutil.WithEviction(vkutil.EvictHighest))
+	zset.Add(ctx, rc, "A", 1)
+	zset.Add(ctx, rc, "B", 2)
+	zset.Add(ctx, rc, "C", 3)
+
+	members, scores, err = zset.Top(ctx, rc, 2)
+	assertRange(members, scores, err, []string{"A", "B"}, []float64{1, 2})
+
+	assertIncrBy(zset, "A", 5, true, 6)
+	assertIncrBy(zset, "D", 4, true, 4)
+
+	assertMembers(zset, []string{"B", "C", "D"}, []float64{2, 3, 4})
+
+	// removing from a set which keeps the most recent also removes from the insertion order
+	zset = vkutil.NewCappedZSet("baz", 3, time.Minute*5, vkutil.WithEviction(vkutil.EvictOldest))
+	zset.Add(ctx, rc, "A", 1)
+	zset.Add(ctx, rc, "B", 2)
+	zset.Add(ctx, rc, "C", 3)
+
+	assert.NoError(t, zset.Rem(ctx, rc, "B"))
+
+	assertvk.ZGetAll(t, rc, "baz", map[string]float64{"A": 1, "C": 3})
+	assertvk.ZGetAll(t, rc, "{baz}:order", map[string]float64{"A": 1, "C": 3})
+}
+
+func TestCappedZSetAddMany(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	assertAddMany := func(s *vkutil.CappedZSet, members []string, scores []float64, expected []bool) {
+		actual, err := s.AddMany(ctx, rc, members, scores)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	zset := vkutil.NewCappedZSet("foo", 3, time.Minute*5)
+	assertAddMany(zset, []string{}, []float64{}, []bool{})
+	assertAddMany(zset, []string{"A", "B", "C", "D", "E"}, []float64{5, 1, 4, 2, 3}, []bool{true, false, true, false, true})
+
+	assertvk.ZGetAll(t, rc, "foo", map[string]float64{"A": 5, "C": 4, "E": 3})
+
+	assertAddMany(zset, []string{"F", "A"}, []float64{3.5, 1}, []bool{true, false})
+
+	assertvk.ZGetAll(t, rc, "foo", map[string]float64{"C": 4, "F": 3.5, "E": 3})
+
+	_, err := zset.AddMany(ctx, rc, []string{"A", "B"}, []float64{1})
+	assert.EqualError(t, err, "got 2 members but 1 scores")
+
+	// batches added to a set which keeps the most recent are ordered as given
+	zset = vkutil.NewCappedZSet("bar", 3, time.Minute*5, vkutil.WithEviction(vkutil.EvictOldest))
+	assertAddMany(zset, []string{"A", "B", "C", "D"}, []float64{4, 3, 2, 1}, []bool{false, true, true, true})
+	assertAddMany(zset, []string{"E", "B"}, []float64{0, 5}, []bool{true, true})
+
+	assertvk.ZGetAll(t, rc, "bar", map[string]float64{"D": 1, "E": 0, "B": 5})
+	assertvk.ZGetAll(t, rc, "{bar}:order", map[string]float64{"D": 4, "E": 5, "B": 6})
+	// large batches can evict many members at once
+	zset = vkutil.NewCappedZSet("big", 1, time.Minute*5, vkutil.WithEviction(vkutil.EvictOldest))
+	members, scores := make([]string, 10000), make([]float64, 10000)
+	for i := range members {
+		members[i], scores[i] = fmt.Sprintf("M%d", i), float64(i)
+	}
+
+	survived, err := zset.AddMany(ctx, rc, members, scores)
+	assert.NoError(t, err)
+	assert.Len(t, survived, 10000)
+	assert.True(t, survived[9999])
+	assert.False(t, survived[0])
+
+	assertvk.ZGetAll(t, rc, "big", map[string]float64{"M9999": 9999})
+	assertvk.ZGetAll(t, rc, "{big}:order", map[string]float64{"M9999": 10000})
 }
@@ -0,0 +1,563 @@
+package vkutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+)
+
+// commands which don't take a key and so can be sent to any cluster node
+var keylessCommands = map[string]bool{
+	"": true, "ASKING": true, "AUTH": true, "CLIENT": true, "CLUSTER": true, "DBSIZE": true, "DISCARD": true,
+	"ECHO": true, "EXEC": true, "FLUSHALL": true, "FLUSHDB": true, "INFO": true, "KEYS": true, "MULTI": true,
+	"PING": true, "READONLY": true, "ROLE": true, "SCRIPT": true, "SELECT": true, "TIME": true, "UNWATCH": true,
+}
+
+// KeySlot returns the cluster hash slot of the given key. If the key contains a hash tag, e.g. {foo}:bar, then only
+// the tag is hashed.
+func KeySlot(key string) int {
+	if tag, ok := hashTag(key); ok {
+		key = tag
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// gets the hash tag of the given key, if it has one
+func hashTag(key string) (string, bool) {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end], true
+		}
+	}
+	return "", false
+}
+
+// CRC16 using the XMODEM polynomial as used by cluster key hashing
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// NewClusterPool creates a new pool for a Valkey Cluster. The host of the URL is used as a seed node from which the
+// slot layout of the cluster is discovered, and connections from the pool then send each command to the node which
+// owns its key, following MOVED and ASK redirects. All keys used in a MULTI block or script must be in the same slot,
+// so interval based types should be created with the WithHashTag option.
+//
+// Sent commands are buffered until they're flushed, and then sent together to the node which owns their keys, so
+// they must all use keys in the same slot. Receive can be used to read their replies, but connections can't be used
+// for pub/sub.
+func NewClusterPool(redisURL string, options ...PoolOption) (*redis.Pool, error) {
+	cfg, err := newPoolConfig(redisURL, options)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.network != "tcp" {
+		return nil, errors.New("cluster pools can't use unix sockets")
+	}
+	if cfg.db != 0 {
+		return nil, errors.New("cluster pools can only use database 0")
+	}
+	if len(cfg.replicaURLs) > 0 {
+		return nil, errors.New("cluster pools don't support read replicas")
+	}
+
+	c := &cluster{cfg: cfg, seed: cfg.address, nodes: make(map[string]*redis.Pool)}
+
+	if err := c.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	rp := cfg.build(func(context.Context) (redis.Conn, error) {
+		return &clusterConn{cluster: c, conns: make(map[string]redis.Conn)}, nil
+	})
+
+	cfg.customize(rp)
+
+	if err := checkPool(rp); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+type cluster struct {
+	cfg  *poolConfig
+	seed string
+
+	mutex sync.RWMutex
+	slots [clusterSlots]string   // address of the node which owns each slot
+	nodes map[string]*redis.Pool // pool for each node address
+}
+
+// reloads the slot layout from the first node that can provide it
+func (c *cluster) refresh(ctx context.Context) error {
+	c.mutex.RLock()
+	addrs := []string{c.seed}
+	for addr := range c.nodes {
+		if addr != c.seed {
+			addrs = append(addrs, addr)
+		}
+	}
+	c.mutex.RUnlock()
+
+	var lastErr error
+
+	for _, addr := range addrs {
+		slots, err := c.loadSlots(ctx, addr)
+		if err == nil {
+			c.mutex.Lock()
+			c.slots = slots
+			c.mutex.Unlock()
+			return nil
+		}
+		lastErr = err
+	}
+
+	return fmt.Errorf("error loading cluster slots: %w", lastErr)
+}
+
+func (c *cluster) loadSlots(ctx context.Context, addr string) ([clusterSlots]string, error) {
+	var slots [clusterSlots]string
+
+	conn, err := c.node(addr).GetContext(ctx)
+	if err != nil {
+		return slots, err
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(redis.DoContext(conn, ctx, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+
+	seedHost, _, _ := net.SplitHostPort(addr)
+
+	for _, r := range ranges {
+		var start, end int
+		var primary []any
+		vals, err := redis.Values(r, nil)
+		if err != nil {
+			return slots, err
+		}
+		if _, err := redis.Scan(vals, &start, &end, &primary); err != nil {
+			return slots, err
+		}
+
+		var host string
+		var port int
+		if _, err := redis.Scan(primary, &host, &port); err != nil {
+			return slots, err
+		}
+		if host == "" {
+			host = seedHost // node doesn't know its own address so use the one we connected to
+		}
+
+		nodeAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		for s := start; s <= end && s < clusterSlots; s++ {
+			slots[s] = nodeAddr
+		}
+	}
+	return slots, nil
+}
+
+// gets the address of the node which owns the given slot, or any node if slot is -1
+func (c *cluster) addrForSlot(slot int) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if slot < 0 {
+		slot = 0
+	}
+	if addr := c.slots[slot]; addr != "" {
+		return addr
+	}
+	return c.seed
+}
+
+// gets the pool for the node with the given address, creating it if necessary
+func (c *cluster) node(addr string) *redis.Pool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	p := c.nodes[addr]
+	if p == nil {
+		p = c.cfg.pool(c.cfg.dialer(func(context.Context) (string, error) { return addr, nil }))
+		p.MaxActive = 0 // cluster pool limits active connections
+		c.nodes[addr] = p
+	}
+	return p
+}
+
+type command struct {
+	name string
+	args []any
+}
+
+// clusterConn is a connection which routes commands to the cluster node which owns their key. Sent commands are
+// buffered and then sent together to a single node when they're flushed or Do is called.
+type clusterConn struct {
+	cluster  *cluster
+	pending  []command
+	received []any                 // replies to flushed commands which haven't been received yet
+	conns    map[string]redis.Conn // connections to nodes we've used
+}
+
+func (c *clusterConn) Close() error {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	return nil // connections to nodes are replaced if they fail
+}
+
+func (c *clusterConn) Send(cmd string, args ...any) error {
+	c.pending = append(c.pending, command{name: cmd, args: args})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	return c.flush(context.Background(), redis.DoContext)
+}
+
+// sends pending commands and keeps their replies to be received
+func (c *clusterConn) flush(ctx context.Context, do doFunc) error {
+	cmds := c.pending
+	c.pending = nil
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	replies, err := c.exec(ctx, do, cmds)
+	if err != nil {
+		return err
+	}
+	c.received = append(c.received, replies...)
+	return nil
+}
+
+func (c *clusterConn) Receive() (any, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *clusterConn) ReceiveContext(ctx context.Context) (any, error) {
+	return c.receive(ctx, redis.DoContext)
+}
+
+func (c *clusterConn) ReceiveWithTimeout(timeout time.Duration) (any, error) {
+	return c.receive(context.Background(), doWithTimeout(timeout))
+}
+
+func (c *clusterConn) receive(ctx context.Context, do doFunc) (any, error) {
+	if err := c.flush(ctx, do); err != nil {
+		return nil, err
+	}
+	if len(c.received) == 0 {
+		return nil, errors.New("no pending replies to receive")
+	}
+
+	reply := c.received[0]
+	c.received = c.received[1:]
+
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *clusterConn) Do(cmd string, args ...any) (any, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *clusterConn) DoContext(ctx context.Context, cmd string, args ...any) (any, error) {
+	return c.do(ctx, redis.DoContext, cmd, args...)
+}
+
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...any) (any, error) {
+	return c.do(context.Background(), doWithTimeout(timeout), cmd, args...)
+}
+
+func (c *clusterConn) do(ctx context.Context, do doFunc, cmd string, args ...any) (any, error) {
+	cmds := c.pending
+	c.pending = nil
+	if cmd != "" {
+		cmds = append(cmds, command{name: cmd, args: args})
+	}
+
+	replies := c.received
+	c.received = nil
+
+	if len(cmds) > 0 {
+		r, err := c.exec(ctx, do, cmds)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, r...)
+	}
+
+	// like a regular connection, flushing returns all pending replies
+	if cmd == "" {
+		return append([]any{}, replies...), nil
+	}
+
+	// otherwise return the reply to this command, and the first error reply
+	var err error
+	for _, r := range replies {
+		if e, ok := r.(redis.Error); ok && err == nil {
+			err = e
+		}
+	}
+	return replies[len(replies)-1], err
+}
+
+// sends the given commands to the node which owns their slot, following redirects, and returns their replies. Only
+// commands which were redirected are sent again, along with the rest of their transaction if they're in one.
+func (c *clusterConn) exec(ctx context.Context, do doFunc, cmds []command) ([]any, error) {
+	slot, err := commandsSlot(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := c.cluster.addrForSlot(slot)
+	asking := false
+	replies := make([]any, len(cmds))
+	todo := transactions(cmds)
+
+	for range clusterMaxRedirects {
+		var batch []command
+		for _, t := range todo {
+			batch = append(batch, cmds[t.start:t.end]...)
+		}
+
+		r, err := c.doOn(ctx, do, addr, asking, batch)
+		if err != nil {
+			return nil, err
+		}
+
+		var redirected []span
+		var redirect, target string
+
+		for _, t := range todo {
+			tr := r[:t.end-t.start]
+			r = r[len(tr):]
+			copy(replies[t.start:t.end], tr)
+
+			if rd, tg := parseRedirect(tr); rd != "" {
+				redirected = append(redirected, t)
+				if redirect == "" {
+					redirect, target = rd, tg
+				}
+			}
+		}
+
+		switch redirect {
+		case "MOVED":
+			c.cluster.refresh(ctx) // slot has moved permanently so our layout is stale
+			addr, asking = target, false
+		case "ASK":
+			addr, asking = target, true // slot is being migrated so just ask for these commands
+		default:
+			return replies, nil
+		}
+		todo = redirected
+	}
+
+	return nil, errors.New("too many cluster redirects")
+}
+
+// sends the given commands to the node with the given address and returns their replies. If asking, each command
+// outside of a transaction is preceded by ASKING, as is each MULTI since that covers the whole transaction.
+func (c *clusterConn) doOn(ctx context.Context, do doFunc, addr string, asking bool, cmds []command) ([]any, error) {
+	conn, err := c.connTo(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	multi := false
+	asked := make([]bool, 0, len(cmds)) // whether each reply is to an ASKING
+
+	for _, cm := range cmds {
+		if asking && !multi {
+			conn.Send("ASKING")
+			asked = append(asked, true)
+		}
+		conn.Send(cm.name, cm.args...)
+		asked = append(asked, false)
+
+		switch strings.ToUpper(cm.name) {
+		case "MULTI":
+			multi = true
+		case "EXEC", "DISCARD":
+			multi = false
+		}
+	}
+
+	replies, err := redis.Values(do(conn, ctx, ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) != len(asked) {
+		return nil, fmt.Errorf("expected %d replies but got %d", len(asked), len(replies))
+	}
+
+	results := make([]any, 0, len(cmds))
+	for i, r := range replies {
+		if !asked[i] {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// gets a connection to the node with the given address, reusing a previous one if it's still healthy
+func (c *clusterConn) connTo(ctx context.Context, addr string) (redis.Conn, error) {
+	if c.conns == nil {
+		c.conns = make(map[string]redis.Conn)
+	}
+
+	conn := c.conns[addr]
+	if conn != nil && conn.Err() == nil {
+		return conn, nil
+	}
+	if conn != nil {
+		conn.Close()
+	}
+
+	conn, err := c.cluster.node(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// gets the slot of the keys used by the given commands, or -1 if they don't use any keys
+func commandsSlot(cmds []command) (int, error) {
+	slot := -1
+	for _, cm := range cmds {
+		if key, ok := commandKey(cm.name, cm.args); ok {
+			s := KeySlot(key)
+			if slot >= 0 && s != slot {
+				return 0, errors.New("commands sent together must use keys in the same slot")
+			}
+			slot = s
+		}
+	}
+	return slot, nil
+}
+
+// span is a range of commands
+type span struct {
+	start, end int
+}
+
+// splits the given commands into transactions which must be sent together, with other commands each on their own
+func transactions(cmds []command) []span {
+	var spans []span
+	start := -1
+
+	for i, cm := range cmds {
+		switch strings.ToUpper(cm.name) {
+		case "MULTI":
+			start = i
+			continue
+		case "EXEC", "DISCARD":
+			if start >= 0 {
+				spans = append(spans, span{start, i + 1})
+				start = -1
+				continue
+			}
+		}
+		if start < 0 {
+			spans = append(spans, span{i, i + 1})
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{start, len(cmds)}) // transaction which hasn't been executed yet
+	}
+	return spans
+}
+
+// gets the key of the given command, if it has one
+func commandKey(cmd string, args []any) (string, bool) {
+	cmd = strings.ToUpper(cmd)
+
+	switch {
+	case keylessCommands[cmd]:
+		return "", false
+	case cmd == "EVAL" || cmd == "EVALSHA" || cmd == "EVAL_RO" || cmd == "EVALSHA_RO":
+		if len(args) < 3 {
+			return "", false
+		}
+		if intArg(args[1]) > 0 {
+			return keyString(args[2]), true
+		}
+		return "", false
+	case len(args) > 0:
+		return keyString(args[0]), true
+	}
+	return "", false
+}
+
+func keyString(arg any) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	}
+	return fmt.Sprint(arg)
+}
+
+// gets the integer value of a command argument
+func intArg(arg any) int {
+	switch a := arg.(type) {
+	case int:
+		return a
+	case int64:
+		return int(a)
+	}
+	n, _ := strconv.Atoi(keyString(arg))
+	return n
+}
+
+// parses the first MOVED or ASK error in the given replies into the type of redirect and the target address
+func parseRedirect(replies []any) (string, string) {
+	for _, r := range replies {
+		rerr, ok := r.(redis.Error)
+		if !ok {
+			continue
+		}
+
+		parts := strings.Fields(string(rerr))
+		if len(parts) == 3 && (parts[0] == "MOVED" || parts[0] == "ASK") {
+			return parts[0], parts[2]
+		}
+		return "", "" // only the first error can be a redirect as that's what aborts a transaction
+	}
+	return "", ""
+}
@@ -0,0 +1,234 @@
+package vkutil_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/nyaruka/vkutil/assertvk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, 12739, vkutil.KeySlot("123456789"))
+	assert.Equal(t, 12182, vkutil.KeySlot("foo"))
+	assert.Equal(t, 11058, vkutil.KeySlot("somekey"))
+	assert.Equal(t, 12182, vkutil.KeySlot("{foo}:2021-11-18"))
+	assert.Equal(t, 12182, vkutil.KeySlot("bar{foo}"))
+	assert.NotEqual(t, vkutil.KeySlot("foo"), vkutil.KeySlot("{}foo")) // empty tag means whole key is hashed
+}
+
+func TestNewClusterPool(t *testing.T) {
+	ctx := context.Background()
+
+	// two fake nodes which share a store but each only accept keys in the slots they own, and node 1 also accepts
+	// a key being migrated after ASKING
+	var mutex sync.Mutex
+	store := map[string]string{}
+	served := map[string][]string{}
+	var split atomic.Int64 // node 1 owns slots before this and node 2 owns the rest
+	split.Store(16384)
+
+	var addrs [2]string
+	var asking atomic.Bool
+
+	node := func(n int) func([]string) string {
+		return func(args []string) string {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			switch strings.ToUpper(args[0]) {
+			case "PING":
+				return "+PONG\r\n"
+			case "ASKING":
+				asking.Store(true)
+				return "+OK\r\n"
+			case "CLUSTER":
+				s := int(split.Load())
+				port1, port2 := addrs[0][strings.LastIndex(addrs[0], ":")+1:], addrs[1][strings.LastIndex(addrs[1], ":")+1:]
+				if s == 16384 {
+					return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$0\r\n\r\n:%s\r\n", port1)
+				}
+				return fmt.Sprintf("*2\r\n*3\r\n:0\r\n:%d\r\n*2\r\n$0\r\n\r\n:%s\r\n*3\r\n:%d\r\n:16383\r\n*2\r\n$9\r\n127.0.0.1\r\n:%s\r\n", s-1, port1, s, port2)
+			}
+
+			key := args[1]
+			slot := vkutil.KeySlot(key)
+			owner := 0
+			if slot >= int(split.Load()) {
+				owner = 1
+			}
+			if key == "moving" { // key is being migrated from node 2 to node 1
+				if n == 1 {
+					return fmt.Sprintf("-ASK %d %s\r\n", slot, addrs[0])
+				}
+				if !asking.Swap(false) {
+					return fmt.Sprintf("-MOVED %d %s\r\n", slot, addrs[1])
+				}
+				owner = 0
+			}
+			if owner != n {
+				return fmt.Sprintf("-MOVED %d %s\r\n", slot, addrs[owner])
+			}
+
+			served[addrs[n]] = append(served[addrs[n]], key)
+
+			switch strings.ToUpper(args[0]) {
+			case "SET":
+				store[key] = args[2]
+				return "+OK\r\n"
+			case "GET":
+				if v, ok := store[key]; ok {
+					return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+				}
+				return "$-1\r\n"
+			}
+			return "-ERR unknown command\r\n"
+		}
+	}
+	addrs[0] = fakeServer(t, node(0))
+	addrs[1] = fakeServer(t, node(1))
+	_, port1, _ := net.SplitHostPort(addrs[0])
+
+	rp, err := vkutil.NewClusterPool("redis://localhost:" + port1)
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// node 1 owns everything
+	_, err = redis.DoContext(rc, ctx, "SET", "foo", "1") // slot 12182
+	assert.NoError(t, err)
+	_, err = redis.DoContext(rc, ctx, "SET", "bar", "2") // slot 5061
+	assert.NoError(t, err)
+
+	// slots are split between the nodes but our layout is stale
+	split.Store(8192)
+
+	val, err := redis.String(redis.DoContext(rc, ctx, "GET", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", val)
+
+	// pipelined commands are sent to the node that owns their keys
+	rc.Send("SET", "{foo}:a", "3")
+	val, err = redis.String(redis.DoContext(rc, ctx, "GET", "{foo}:a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	val, err = redis.String(redis.DoContext(rc, ctx, "GET", "bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2", val)
+
+	// key in a slot being migrated is redirected by an ASK
+	_, err = redis.DoContext(rc, ctx, "SET", "moving", "4") // slot 14604
+	assert.NoError(t, err)
+
+	mutex.Lock()
+	assert.Equal(t, []string{"foo", "bar", "bar", "moving"}, served[addrs[0]])
+	assert.Equal(t, []string{"foo", "{foo}:a", "{foo}:a"}, served[addrs[1]])
+	mutex.Unlock()
+
+	// flushing returns all pending replies
+	rc.Send("SET", "{foo}:b", "5")
+	rc.Send("GET", "{foo}:b")
+	replies, err := redis.Values(rc.Do(""))
+	assert.NoError(t, err)
+	assert.Equal(t, []any{"OK", []byte("5")}, replies)
+
+	// as does receiving after a flush
+	rc.Send("GET", "foo")
+	rc.Send("GET", "{foo}:c")
+	assert.NoError(t, rc.Flush())
+
+	val, err = redis.String(rc.Receive())
+	assert.NoError(t, err)
+	assert.Equal(t, "1", val)
+
+	_, err = redis.String(rc.Receive())
+	assert.Equal(t, redis.ErrNil, err)
+
+	_, err = rc.Receive()
+	assert.EqualError(t, err, "no pending replies to receive")
+
+	// commands can also be sent and received with timeouts
+	val, err = redis.String(redis.DoWithTimeout(rc, time.Second, "GET", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", val)
+
+	rc.Send("GET", "{foo}:a")
+	val, err = redis.String(redis.ReceiveWithTimeout(rc, time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	// commands sent together must use keys in the same slot, and none are sent if they don't
+	rc.Send("SET", "foo", "7")
+	rc.Send("SET", "bar", "8")
+	_, err = rc.Do("")
+	assert.EqualError(t, err, "commands sent together must use keys in the same slot")
+
+	// only commands which are redirected are sent again
+	mutex.Lock()
+	served = map[string][]string{}
+	mutex.Unlock()
+
+	rc.Send("SET", "{moving}:x", "5")
+	_, err = redis.DoContext(rc, ctx, "SET", "moving", "6")
+	assert.NoError(t, err)
+
+	mutex.Lock()
+	assert.Equal(t, []string{"moving"}, served[addrs[0]])
+	assert.Equal(t, []string{"{moving}:x"}, served[addrs[1]])
+	assert.Equal(t, "1", store["foo"])
+	mutex.Unlock()
+
+	_, err = vkutil.NewClusterPool("redis://localhost:" + port1 + "/2")
+	assert.EqualError(t, err, "cluster pools can only use database 0")
+
+	_, err = vkutil.NewClusterPool("unix:///var/run/valkey.sock")
+	assert.EqualError(t, err, "cluster pools can't use unix sockets")
+
+	_, err = vkutil.NewClusterPool("redis://localhost:"+port1, vkutil.WithReadReplicas("redis://localhost:1"))
+	assert.EqualError(t, err, "cluster pools don't support read replicas")
+
+	_, err = vkutil.NewClusterPool("redis://localhost:1")
+	assert.ErrorContains(t, err, "error loading cluster slots: ")
+}
+
+func TestIntervalKeysWithHashTag(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	dates.SetNowFunc(dates.NewFixedNow(time.Date(2021, 11, 18, 12, 7, 3, 234567, time.UTC)))
+
+	set := vkutil.NewIntervalSet("foos", time.Hour*24, 2, vkutil.WithHashTag())
+	assert.NoError(t, set.Add(ctx, rc, "A"))
+
+	hash := vkutil.NewIntervalHash("bars", time.Hour*24, 2, vkutil.WithHashTag())
+	assert.NoError(t, hash.Set(ctx, rc, "A", "1"))
+
+	series := vkutil.NewIntervalSeries("bazs", time.Hour, 2, vkutil.WithHashTag())
+	assert.NoError(t, series.Record(ctx, rc, "A", 1))
+
+	assertvk.Keys(t, rc, "*", []string{"{bars}:2021-11-18", "{bazs}:2021-11-18T12:00", "{foos}:2021-11-18"})
+
+	// all intervals of a structure are in the same slot
+	assert.Equal(t, vkutil.KeySlot("{foos}:2021-11-18"), vkutil.KeySlot("{foos}:2021-11-17"))
+
+	isMember, err := set.IsMember(ctx, rc, "A")
+	assert.NoError(t, err)
+	assert.True(t, isMember)
+}
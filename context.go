@@ -0,0 +1,48 @@
+package vkutil
+
+import "context"
+
+type contextKey int
+
+const (
+	readOnlyKey contextKey = iota
+	operationKey
+)
+
+// describes the vkutil operation that commands are being sent for
+type operationInfo struct {
+	name       string
+	idempotent bool // whether it's safe to retry
+}
+
+// marks the given context as being for the given vkutil operation, unless it's already part of an operation
+func withOperation(ctx context.Context, name string, idempotent bool) context.Context {
+	if operation(ctx).name != "" {
+		return ctx
+	}
+	return context.WithValue(ctx, operationKey, operationInfo{name: name, idempotent: idempotent})
+}
+
+func operation(ctx context.Context) operationInfo {
+	v, _ := ctx.Value(operationKey).(operationInfo)
+	return v
+}
+
+// Idempotent marks the given context as being for commands which are safe to retry, so that pools created with the
+// WithRetry option will retry them if they fail with a transient error. Operations of types like IntervalSet already
+// declare whether they are idempotent.
+func Idempotent(ctx context.Context) context.Context {
+	op := operation(ctx)
+	op.idempotent = true
+	return context.WithValue(ctx, operationKey, op)
+}
+
+// marks the given context as being for a read which can be served by a replica
+func readOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey, true)
+}
+
+func isReadOnly(ctx context.Context) bool {
+	v, _ := ctx.Value(readOnlyKey).(bool)
+	return v
+}
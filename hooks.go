@@ -0,0 +1,152 @@
+package vkutil
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// CommandInfo describes a command sent to the server, along with any commands sent ahead of it which are flushed with
+// it. When pending commands are flushed without a new command, e.g. by Do(""), Name is empty.
+type CommandInfo struct {
+	Name      string   // e.g. GET or EVALSHA
+	Operation string   // vkutil operation which sent the command, e.g. IntervalSet.IsMember, if any
+	KeyCount  int      // number of keys the command and any pipelined commands operate on
+	Pipelined []string // names of the commands which were sent ahead of this command and flushed with it
+
+	// only set when the command has completed
+	Duration time.Duration
+	Err      error
+}
+
+// Hook observes the commands sent on connections from a pool, e.g. for tracing or logging slow commands
+type Hook interface {
+	// BeforeCommand is called before a command is sent, and can return a new context, e.g. with a tracing span
+	BeforeCommand(ctx context.Context, cmd *CommandInfo) context.Context
+
+	// AfterCommand is called after a command has completed
+	AfterCommand(ctx context.Context, cmd *CommandInfo)
+}
+
+// WithHook adds a hook to observe commands sent on connections from the pool
+func WithHook(h Hook) PoolOption {
+	return func(c *poolConfig) { c.hooks = append(c.hooks, h) }
+}
+
+// wraps the dial function of the given pool so that connections call the configured hooks
+func (c *poolConfig) instrument(rp *redis.Pool) *redis.Pool {
+	hooks := c.hooks
+	if c.metrics != nil {
+		c.metrics.attach(rp)
+		hooks = append(hooks[:len(hooks):len(hooks)], &metricsHook{c.metrics})
+	}
+	if len(hooks) == 0 {
+		return rp
+	}
+
+	dial := rp.DialContext
+	rp.DialContext = func(ctx context.Context) (redis.Conn, error) {
+		conn, err := dial(ctx)
+		if c.metrics != nil {
+			c.metrics.recordDial(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &hookConn{Conn: conn, hooks: hooks}, nil
+	}
+	return rp
+}
+
+// hookConn is a connection which calls hooks for each command sent with Do, including any commands sent ahead of it
+type hookConn struct {
+	redis.Conn
+
+	hooks   []Hook
+	pending []command
+}
+
+func (c *hookConn) Send(cmd string, args ...any) error {
+	c.pending = append(c.pending, command{name: cmd, args: args})
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *hookConn) Receive() (any, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *hookConn) ReceiveContext(ctx context.Context) (any, error) {
+	if len(c.pending) > 0 {
+		c.pending = c.pending[1:]
+	}
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func (c *hookConn) ReceiveWithTimeout(timeout time.Duration) (any, error) {
+	if len(c.pending) > 0 {
+		c.pending = c.pending[1:]
+	}
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+func (c *hookConn) Do(cmd string, args ...any) (any, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *hookConn) DoContext(ctx context.Context, cmd string, args ...any) (any, error) {
+	return c.do(ctx, redis.DoContext, cmd, args...)
+}
+
+func (c *hookConn) DoWithTimeout(timeout time.Duration, cmd string, args ...any) (any, error) {
+	return c.do(context.Background(), doWithTimeout(timeout), cmd, args...)
+}
+
+func (c *hookConn) do(ctx context.Context, do doFunc, cmd string, args ...any) (any, error) {
+	pending := c.pending
+	c.pending = nil
+
+	if cmd == "" && len(pending) == 0 {
+		return do(c.Conn, ctx, cmd, args...) // nothing to flush, e.g. when returned to the pool
+	}
+
+	info := &CommandInfo{Name: strings.ToUpper(cmd), Operation: operation(ctx).name, KeyCount: keyCount(cmd, args)}
+	for _, p := range pending {
+		info.Pipelined = append(info.Pipelined, strings.ToUpper(p.name))
+		info.KeyCount += keyCount(p.name, p.args)
+	}
+
+	for _, h := range c.hooks {
+		ctx = h.BeforeCommand(ctx, info)
+	}
+
+	start := time.Now()
+	reply, err := do(c.Conn, ctx, cmd, args...)
+	info.Duration, info.Err = time.Since(start), err
+
+	for _, h := range c.hooks {
+		h.AfterCommand(ctx, info)
+	}
+	return reply, err
+}
+
+// gets the number of keys used by the given command
+func keyCount(cmd string, args []any) int {
+	cmd = strings.ToUpper(cmd)
+
+	switch cmd {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO":
+		if len(args) > 1 {
+			return intArg(args[1])
+		}
+		return 0
+	case "DEL", "EXISTS", "MGET", "TOUCH", "UNLINK", "WATCH":
+		return len(args)
+	}
+
+	if _, ok := commandKey(cmd, args); ok {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package vkutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type spanKey struct{}
+
+type testHook struct {
+	commands []vkutil.CommandInfo
+	spans    []string
+}
+
+func (h *testHook) BeforeCommand(ctx context.Context, cmd *vkutil.CommandInfo) context.Context {
+	return context.WithValue(ctx, spanKey{}, "span:"+cmd.Name)
+}
+
+func (h *testHook) AfterCommand(ctx context.Context, cmd *vkutil.CommandInfo) {
+	h.commands = append(h.commands, *cmd)
+	h.spans = append(h.spans, ctx.Value(spanKey{}).(string))
+}
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	hook := &testHook{}
+
+	// flush scripts so we can see them being loaded
+	c, err := redis.Dial("tcp", "valkey8:6379")
+	require.NoError(t, err)
+	_, err = redis.DoContext(c, ctx, "SCRIPT", "FLUSH")
+	require.NoError(t, err)
+	c.Close()
+
+	rp, err := vkutil.NewPool("redis://valkey8:6379/15", vkutil.WithHook(hook))
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer redis.DoContext(rc, ctx, "FLUSHDB")
+
+	set := vkutil.NewIntervalSet("foos", time.Hour, 2)
+	assert.NoError(t, set.Add(ctx, rc, "A"))
+
+	_, err = set.IsMember(ctx, rc, "A")
+	assert.NoError(t, err)
+
+	locker := vkutil.NewLocker("test_lock", time.Minute)
+	_, err = locker.Grab(ctx, rp, time.Second)
+	assert.NoError(t, err)
+
+	_, err = redis.DoContext(rc, ctx, "mget", "foo", "bar")
+	assert.NoError(t, err)
+	_, err = redis.DoContext(rc, ctx, "INCR", "foo", "bar")
+	assert.EqualError(t, err, "ERR wrong number of arguments for 'incr' command")
+
+	// flushing pipelined commands is also observed
+	rc.Send("SET", "foo", "1")
+	rc.Send("GET", "foo")
+	_, err = rc.Do("")
+	assert.NoError(t, err)
+
+	// as are commands sent with timeouts
+	_, err = redis.DoWithTimeout(rc, time.Second, "GET", "foo")
+	assert.NoError(t, err)
+
+	// strip durations which will vary
+	for i, c := range hook.commands {
+		assert.Greater(t, c.Duration, time.Duration(0))
+		hook.commands[i].Duration = 0
+	}
+
+	assert.Equal(t, []vkutil.CommandInfo{
+		{Name: "PING"},
+		{Name: "EXEC", Operation: "IntervalSet.Add", KeyCount: 2, Pipelined: []string{"MULTI", "SADD", "EXPIRE"}},
+		{Name: "EVALSHA_RO", Operation: "IntervalSet.IsMember", KeyCount: 2, Err: hook.commands[2].Err},
+		{Name: "EVAL_RO", Operation: "IntervalSet.IsMember", KeyCount: 2},
+		{Name: "SET", Operation: "Locker.Grab", KeyCount: 1},
+		{Name: "MGET", KeyCount: 2},
+		{Name: "INCR", KeyCount: 1, Err: hook.commands[6].Err},
+		{Name: "", KeyCount: 2, Pipelined: []string{"SET", "GET"}},
+		{Name: "GET", KeyCount: 1},
+	}, hook.commands)
+	assert.ErrorContains(t, hook.commands[2].Err, "NOSCRIPT")
+	assert.Equal(t, []string{"span:PING", "span:EXEC", "span:EVALSHA_RO", "span:EVAL_RO", "span:SET", "span:MGET", "span:INCR", "span:", "span:GET"}, hook.spans)
+}
+
+func TestHooksPubSub(t *testing.T) {
+	ctx := context.Background()
+	hook := &testHook{}
+
+	rp, err := vkutil.NewPool("redis://valkey8:6379/15", vkutil.WithHook(hook))
+	require.NoError(t, err)
+
+	psc := redis.PubSubConn{Conn: rp.Get()}
+	defer psc.Close()
+
+	require.NoError(t, psc.Subscribe("test_hooks"))
+	assert.IsType(t, redis.Subscription{}, psc.ReceiveWithTimeout(time.Second))
+
+	pc := rp.Get()
+	defer pc.Close()
+
+	_, err = redis.DoContext(pc, ctx, "PUBLISH", "test_hooks", "hello")
+	require.NoError(t, err)
+
+	msg := psc.ReceiveWithTimeout(time.Second)
+	assert.Equal(t, redis.Message{Channel: "test_hooks", Data: []byte("hello")}, msg)
+}
@@ -17,16 +17,18 @@ type IntervalHash struct {
 }
 
 // NewIntervalHash creates a new empty interval hash
-func NewIntervalHash(keyBase string, interval time.Duration, size int) *IntervalHash {
-	return &IntervalHash{keyBase: keyBase, interval: interval, size: size}
+func NewIntervalHash(keyBase string, interval time.Duration, size int, options ...IntervalOption) *IntervalHash {
+	return &IntervalHash{keyBase: intervalKeyBase(keyBase, options), interval: interval, size: size}
 }
 
 //go:embed lua/ihash_get.lua
 var ihashGet string
-var ihashGetScript = redis.NewScript(-1, ihashGet)
+var ihashGetScript = newReadScript(ihashGet)
 
 // Get returns the value of the given field
 func (h *IntervalHash) Get(ctx context.Context, rc redis.Conn, field string) (string, error) {
+	ctx = withOperation(ctx, "IntervalHash.Get", true)
+
 	keys := h.keys()
 
 	value, err := redis.String(ihashGetScript.DoContext(ctx, rc, redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field)...))
@@ -38,10 +40,12 @@ func (h *IntervalHash) Get(ctx context.Context, rc redis.Conn, field string) (st
 
 //go:embed lua/ihash_mget.lua
 var ihashMGet string
-var ihashMGetScript = redis.NewScript(-1, ihashMGet)
+var ihashMGetScript = newReadScript(ihashMGet)
 
 // MGet returns the values of the given fields
 func (h *IntervalHash) MGet(ctx context.Context, rc redis.Conn, fields ...string) ([]string, error) {
+	ctx = withOperation(ctx, "IntervalHash.MGet", true)
+
 	keys := h.keys()
 
 	// for consistency with HMGET, zero fields is an error
@@ -58,6 +62,8 @@ func (h *IntervalHash) MGet(ctx context.Context, rc redis.Conn, fields ...string
 
 // Set sets the value of the given field
 func (h *IntervalHash) Set(ctx context.Context, rc redis.Conn, field, value string) error {
+	ctx = withOperation(ctx, "IntervalHash.Set", true)
+
 	key := h.keys()[0]
 
 	rc.Send("MULTI")
@@ -69,6 +75,8 @@ func (h *IntervalHash) Set(ctx context.Context, rc redis.Conn, field, value stri
 
 // Del removes the given fields
 func (h *IntervalHash) Del(ctx context.Context, rc redis.Conn, fields ...string) error {
+	ctx = withOperation(ctx, "IntervalHash.Del", true)
+
 	rc.Send("MULTI")
 	for _, k := range h.keys() {
 		rc.Send("HDEL", redis.Args{}.Add(k).AddFlat(fields)...)
@@ -79,6 +87,8 @@ func (h *IntervalHash) Del(ctx context.Context, rc redis.Conn, fields ...string)
 
 // Clear removes all fields
 func (h *IntervalHash) Clear(ctx context.Context, rc redis.Conn) error {
+	ctx = withOperation(ctx, "IntervalHash.Clear", true)
+
 	rc.Send("MULTI")
 	for _, k := range h.keys() {
 		rc.Send("DEL", k)
@@ -3,9 +3,12 @@ package vkutil
 import (
 	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/gocommon/dates"
 )
 
 // IntervalSeries returns all values from interval based hashes.
@@ -16,16 +19,47 @@ type IntervalSeries struct {
 }
 
 // NewIntervalSeries creates a new empty series
-func NewIntervalSeries(keyBase string, interval time.Duration, size int) *IntervalSeries {
-	return &IntervalSeries{keyBase: keyBase, interval: interval, size: size}
+func NewIntervalSeries(keyBase string, interval time.Duration, size int, options ...IntervalOption) *IntervalSeries {
+	return &IntervalSeries{keyBase: intervalKeyBase(keyBase, options), interval: interval, size: size}
 }
 
+// Aggregation is a way of combining the values of a field across intervals
+type Aggregation string
+
+// possible aggregations
+const (
+	AggregateSum  Aggregation = "sum"
+	AggregateMax  Aggregation = "max"
+	AggregateMin  Aggregation = "min"
+	AggregateLast Aggregation = "last"
+)
+
 // Record increments the value of field by value in the current interval
 func (s *IntervalSeries) Record(ctx context.Context, rc redis.Conn, field string, value int64) error {
+	ctx = withOperation(ctx, "IntervalSeries.Record", false)
+
+	return s.record(ctx, rc, "HINCRBY", field, value)
+}
+
+// RecordFloat increments the value of field by a float value in the current interval
+func (s *IntervalSeries) RecordFloat(ctx context.Context, rc redis.Conn, field string, value float64) error {
+	ctx = withOperation(ctx, "IntervalSeries.RecordFloat", false)
+
+	return s.record(ctx, rc, "HINCRBYFLOAT", field, value)
+}
+
+// RecordGauge sets the value of field in the current interval, replacing any previously recorded value
+func (s *IntervalSeries) RecordGauge(ctx context.Context, rc redis.Conn, field string, value float64) error {
+	ctx = withOperation(ctx, "IntervalSeries.RecordGauge", true)
+
+	return s.record(ctx, rc, "HSET", field, value)
+}
+
+func (s *IntervalSeries) record(ctx context.Context, rc redis.Conn, cmd, field string, value any) error {
 	currKey := s.keys()[0]
 
 	rc.Send("MULTI")
-	rc.Send("HINCRBY", currKey, field, value)
+	rc.Send(cmd, currKey, field, value)
 	rc.Send("EXPIRE", currKey, s.size*int(s.interval/time.Second))
 	_, err := redis.DoContext(rc, ctx, "EXEC")
 	return err
@@ -33,18 +67,304 @@ func (s *IntervalSeries) Record(ctx context.Context, rc redis.Conn, field string
 
 //go:embed lua/iseries_get.lua
 var iseriesGet string
-var iseriesGetScript = redis.NewScript(-1, iseriesGet)
+var iseriesGetScript = newReadScript(iseriesGet)
 
 // Get gets the values of field in all intervals
 func (s *IntervalSeries) Get(ctx context.Context, rc redis.Conn, field string) ([]int64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Get", true)
+
 	keys := s.keys()
 	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field)
 
 	return redis.Int64s(iseriesGetScript.DoContext(ctx, rc, args...))
 }
 
+// GetFloat gets the values of field in all intervals as floats
+func (s *IntervalSeries) GetFloat(ctx context.Context, rc redis.Conn, field string) ([]float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.GetFloat", true)
+
+	keys := s.keys()
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field)
+
+	return redis.Float64s(iseriesGetScript.DoContext(ctx, rc, args...))
+}
+
+// Aggregate combines the values of field across all intervals. Intervals without a value for field are ignored,
+// and zero is returned if there are no values.
+func (s *IntervalSeries) Aggregate(ctx context.Context, rc redis.Conn, field string, agg Aggregation) (float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Aggregate", true)
+
+	switch agg {
+	case AggregateSum, AggregateMax, AggregateMin, AggregateLast:
+	default:
+		return 0, fmt.Errorf("unknown aggregation: %s", agg)
+	}
+
+	keys := s.keys()
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field)
+
+	vals, err := redis.Values(iseriesGetScript.DoContext(ctx, rc, args...))
+	if err != nil {
+		return 0, err
+	}
+
+	var result float64
+	found := false
+
+	for _, v := range vals {
+		if v == nil {
+			continue
+		}
+		f, err := redis.Float64(v, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		switch agg {
+		case AggregateSum:
+			result += f
+		case AggregateMax:
+			if !found || f > result {
+				result = f
+			}
+		case AggregateMin:
+			if !found || f < result {
+				result = f
+			}
+		case AggregateLast:
+			return f, nil // values are newest first
+		}
+		found = true
+	}
+
+	return result, nil
+}
+
+//go:embed lua/iseries_rate.lua
+var iseriesRate string
+var iseriesRateScript = newReadScript(iseriesRate)
+
+// Rate gets the per second rate of field across all intervals. Since the current interval is only partially
+// complete, only its elapsed time is counted toward the window duration.
+func (s *IntervalSeries) Rate(ctx context.Context, rc redis.Conn, field string) (float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Rate", true)
+
+	now := dates.Now()
+	keys := s.keys()
+	elapsed := now.Sub(now.UTC().Truncate(s.interval))
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field, s.interval.Seconds(), elapsed.Seconds())
+
+	return redis.Float64(iseriesRateScript.DoContext(ctx, rc, args...))
+}
+
+//go:embed lua/iseries_sliding.lua
+var iseriesSliding string
+var iseriesSlidingScript = newReadScript(iseriesSliding)
+
+// SlidingTotal gets an estimate of the total value of field over a window of exactly size-1 intervals ending now.
+// The oldest interval is weighted by the fraction of it which is still inside the window, assuming its values were
+// recorded evenly across it.
+func (s *IntervalSeries) SlidingTotal(ctx context.Context, rc redis.Conn, field string) (float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.SlidingTotal", true)
+
+	if s.size < 2 {
+		return 0, errors.New("sliding window requires at least 2 intervals")
+	}
+
+	now := dates.Now()
+	keys := s.keys()
+	elapsed := now.Sub(now.UTC().Truncate(s.interval))
+	oldestWeight := 1 - elapsed.Seconds()/s.interval.Seconds()
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field, oldestWeight)
+
+	return redis.Float64(iseriesSlidingScript.DoContext(ctx, rc, args...))
+}
+
+//go:embed lua/iseries_wma.lua
+var iseriesWMA string
+var iseriesWMAScript = newReadScript(iseriesWMA)
+
+// MovingAverage gets the weighted average of the per interval values of field. Weights are given newest first and
+// only as many intervals as there are weights are considered. If no weights are given, linearly decreasing weights
+// are used across all intervals. Note that the current interval is included, so give it a zero weight to exclude it.
+func (s *IntervalSeries) MovingAverage(ctx context.Context, rc redis.Conn, field string, weights ...float64) (float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.MovingAverage", true)
+
+	if len(weights) > s.size {
+		return 0, fmt.Errorf("can't have more weights than intervals (%d)", s.size)
+	}
+	if len(weights) == 0 {
+		weights = make([]float64, s.size)
+		for i := range weights {
+			weights[i] = float64(s.size - i)
+		}
+	}
+
+	keys := s.keys()[:len(weights)]
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field).AddFlat(weights)
+
+	return redis.Float64(iseriesWMAScript.DoContext(ctx, rc, args...))
+}
+
+//go:embed lua/iseries_mget.lua
+var iseriesMGet string
+var iseriesMGetScript = newReadScript(iseriesMGet)
+
+// GetMulti gets the values of the given fields in all intervals
+func (s *IntervalSeries) GetMulti(ctx context.Context, rc redis.Conn, fields ...string) ([][]int64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.GetMulti", true)
+
+	keys := s.keys()
+
+	// for consistency with HMGET, zero fields is an error
+	if len(fields) == 0 {
+		return nil, errors.New("wrong number of arguments for command")
+	}
+
+	intervals, err := redis.Values(iseriesMGetScript.DoContext(ctx, rc, redis.Args{}.Add(len(keys)).AddFlat(keys).AddFlat(fields)...))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]int64, len(fields))
+	for f := range fields {
+		values[f] = make([]int64, len(keys))
+	}
+
+	for i, interval := range intervals {
+		vals, err := redis.Int64s(interval, nil)
+		if err != nil {
+			return nil, err
+		}
+		for f, v := range vals {
+			values[f][i] = v
+		}
+	}
+	return values, nil
+}
+
+//go:embed lua/iseries_getall.lua
+var iseriesGetAll string
+var iseriesGetAllScript = newReadScript(iseriesGetAll)
+
+// GetAll gets the values of every field in all intervals, along with the total value of each field. All fields must
+// have integer values, so use GetAllFloat if any have been recorded with RecordFloat or RecordGauge.
+func (s *IntervalSeries) GetAll(ctx context.Context, rc redis.Conn) (map[string][]int64, map[string]int64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.GetAll", true)
+
+	intervals, err := s.getAll(ctx, rc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string][]int64)
+	totals := make(map[string]int64)
+
+	for i, interval := range intervals {
+		vals, err := redis.Int64Map(interval, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for f, v := range vals {
+			if values[f] == nil {
+				values[f] = make([]int64, len(intervals))
+			}
+			values[f][i] = v
+			totals[f] += v
+		}
+	}
+	return values, totals, nil
+}
+
+// GetAllFloat gets the values of every field in all intervals as floats, along with the total value of each field
+func (s *IntervalSeries) GetAllFloat(ctx context.Context, rc redis.Conn) (map[string][]float64, map[string]float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.GetAllFloat", true)
+
+	intervals, err := s.getAll(ctx, rc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string][]float64)
+	totals := make(map[string]float64)
+
+	for i, interval := range intervals {
+		vals, err := redis.Float64Map(interval, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for f, v := range vals {
+			if values[f] == nil {
+				values[f] = make([]float64, len(intervals))
+			}
+			values[f][i] = v
+			totals[f] += v
+		}
+	}
+	return values, totals, nil
+}
+
+// gets the fields and values of each interval
+func (s *IntervalSeries) getAll(ctx context.Context, rc redis.Conn) ([]any, error) {
+	keys := s.keys()
+
+	return redis.Values(iseriesGetAllScript.DoContext(ctx, rc, redis.Args{}.Add(len(keys)).AddFlat(keys)...))
+}
+
+// SeriesPoint is the value of a field in the interval starting at Time
+type SeriesPoint struct {
+	Time  time.Time
+	Value int64
+}
+
+// Points gets the values of field in all intervals along with the start time of each interval, newest first
+func (s *IntervalSeries) Points(ctx context.Context, rc redis.Conn, field string) ([]SeriesPoint, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Points", true)
+
+	return s.points(ctx, rc, field, s.starts())
+}
+
+// Range gets the values of field in the intervals which overlap the given time range, newest first. Only
+// intervals which are still within the series window are considered.
+func (s *IntervalSeries) Range(ctx context.Context, rc redis.Conn, field string, since, until time.Time) ([]SeriesPoint, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Range", true)
+
+	starts := make([]time.Time, 0, s.size)
+	for _, start := range s.starts() {
+		if start.Before(until) && start.Add(s.interval).After(since) {
+			starts = append(starts, start)
+		}
+	}
+
+	return s.points(ctx, rc, field, starts)
+}
+
+func (s *IntervalSeries) points(ctx context.Context, rc redis.Conn, field string, starts []time.Time) ([]SeriesPoint, error) {
+	points := make([]SeriesPoint, len(starts))
+	if len(starts) == 0 {
+		return points, nil
+	}
+
+	keys := make([]string, len(starts))
+	for i, start := range starts {
+		keys[i] = intervalKey(s.keyBase, start, s.interval)
+	}
+
+	vals, err := redis.Int64s(iseriesGetScript.DoContext(ctx, rc, redis.Args{}.Add(len(keys)).AddFlat(keys).Add(field)...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, start := range starts {
+		points[i] = SeriesPoint{Time: start, Value: vals[i]}
+	}
+	return points, nil
+}
+
 // Total gets the total value of field across all intervals
 func (s *IntervalSeries) Total(ctx context.Context, rc redis.Conn, field string) (int64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Total", true)
+
 	vals, err := s.Get(ctx, rc, field)
 	if err != nil {
 		return 0, err
@@ -56,6 +376,58 @@ func (s *IntervalSeries) Total(ctx context.Context, rc redis.Conn, field string)
 	return total, nil
 }
 
+//go:embed lua/iseries_top.lua
+var iseriesTop string
+var iseriesTopScript = newReadScript(iseriesTop)
+
+// Top gets the n fields with the highest totals across all intervals, along with those totals
+func (s *IntervalSeries) Top(ctx context.Context, rc redis.Conn, n int) ([]string, []float64, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Top", true)
+
+	keys := s.keys()
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(n)
+
+	return StringsWithScores(iseriesTopScript.DoContext(ctx, rc, args...))
+}
+
+//go:embed lua/iseries_rollup.lua
+var iseriesRollup string
+var iseriesRollupScript = redis.NewScript(-1, iseriesRollup)
+
+// Rollup adds the values of completed intervals to the corresponding intervals of a coarser series, e.g. to keep
+// daily totals of a series recorded per minute. Values are summed, and intervals already rolled up are skipped,
+// so this should be called regularly, at least once per window of this series, to avoid intervals expiring before
+// they are rolled up. Returns the number of intervals rolled up. In a cluster, both series must share a hash tag,
+// e.g. with key bases like {foos}:minutely and {foos}:daily.
+func (s *IntervalSeries) Rollup(ctx context.Context, rc redis.Conn, dst *IntervalSeries) (int, error) {
+	ctx = withOperation(ctx, "IntervalSeries.Rollup", true)
+
+	if dst.interval <= s.interval || dst.interval%s.interval != 0 {
+		return 0, fmt.Errorf("can't rollup %s intervals into %s intervals", s.interval, dst.interval)
+	}
+
+	starts := s.starts()[1:] // current interval is still being recorded to
+
+	checkpointKey := fmt.Sprintf("%s:rollup:%s", dst.keyBase, s.keyBase)
+	keys := []string{checkpointKey}
+	timestamps := make([]string, 0, len(starts))
+
+	for i := len(starts) - 1; i >= 0; i-- {
+		keys = append(keys, intervalKey(s.keyBase, starts[i], s.interval), intervalKey(dst.keyBase, starts[i], dst.interval))
+		timestamps = append(timestamps, intervalTimestamp(starts[i], s.interval))
+	}
+
+	dstExpire := dst.size * int(dst.interval/time.Second)
+	checkpointExpire := 2 * s.size * int(s.interval/time.Second) // outlives any intervals it refers to
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(dstExpire, checkpointExpire).AddFlat(timestamps)
+
+	return redis.Int(iseriesRollupScript.DoContext(ctx, rc, args...))
+}
+
 func (s *IntervalSeries) keys() []string {
 	return intervalKeys(s.keyBase, s.interval, s.size)
 }
+
+func (s *IntervalSeries) starts() []time.Time {
+	return intervalStarts(dates.Now(), s.interval, s.size)
+}
@@ -103,3 +103,358 @@ func TestIntervalSeries(t *testing.T) {
 	assertTotal(series1, "B", 3)
 	assertTotal(series1, "C", 0)
 }
+
+func TestIntervalSeriesPoints(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	series := vkutil.NewIntervalSeries("foos", time.Minute*5, 3)
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 3, 234567, time.UTC))
+	series.Record(ctx, rc, "A", 2)
+
+	setNow(time.Date(2021, 11, 18, 12, 11, 3, 234567, time.UTC))
+	series.Record(ctx, rc, "A", 3)
+
+	points, err := series.Points(ctx, rc, "A")
+	assert.NoError(t, err)
+	assert.Equal(t, []vkutil.SeriesPoint{
+		{Time: time.Date(2021, 11, 18, 12, 10, 0, 0, time.UTC), Value: 3},
+		{Time: time.Date(2021, 11, 18, 12, 5, 0, 0, time.UTC), Value: 0},
+		{Time: time.Date(2021, 11, 18, 12, 0, 0, 0, time.UTC), Value: 2},
+	}, points)
+
+	// range covering part of the window
+	points, err = series.Range(ctx, rc, "A", time.Date(2021, 11, 18, 12, 3, 0, 0, time.UTC), time.Date(2021, 11, 18, 12, 7, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []vkutil.SeriesPoint{
+		{Time: time.Date(2021, 11, 18, 12, 5, 0, 0, time.UTC), Value: 0},
+		{Time: time.Date(2021, 11, 18, 12, 0, 0, 0, time.UTC), Value: 2},
+	}, points)
+
+	// range extending beyond the window is limited to intervals in the window
+	points, err = series.Range(ctx, rc, "A", time.Date(2021, 11, 18, 11, 0, 0, 0, time.UTC), time.Date(2021, 11, 18, 12, 5, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []vkutil.SeriesPoint{{Time: time.Date(2021, 11, 18, 12, 0, 0, 0, time.UTC), Value: 2}}, points)
+
+	// range entirely outside the window
+	points, err = series.Range(ctx, rc, "A", time.Date(2021, 11, 18, 11, 0, 0, 0, time.UTC), time.Date(2021, 11, 18, 11, 30, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, []vkutil.SeriesPoint{}, points)
+}
+
+func TestIntervalSeriesMultiAndAll(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	series := vkutil.NewIntervalSeries("foos", time.Minute*5, 3)
+
+	// empty series
+	multi, err := series.GetMulti(ctx, rc, "A", "B")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int64{{0, 0, 0}, {0, 0, 0}}, multi)
+
+	values, totals, err := series.GetAll(ctx, rc)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int64{}, values)
+	assert.Equal(t, map[string]int64{}, totals)
+
+	_, err = series.GetMulti(ctx, rc) // zero fields is an error
+	assert.EqualError(t, err, "wrong number of arguments for command")
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 3, 234567, time.UTC))
+	series.Record(ctx, rc, "A", 2)
+	series.Record(ctx, rc, "B", 5)
+
+	setNow(time.Date(2021, 11, 18, 12, 11, 3, 234567, time.UTC))
+	series.Record(ctx, rc, "A", 3)
+	series.Record(ctx, rc, "C", 1)
+
+	multi, err = series.GetMulti(ctx, rc, "C", "A", "D")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int64{{1, 0, 0}, {3, 0, 2}, {0, 0, 0}}, multi)
+
+	values, totals, err = series.GetAll(ctx, rc)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int64{"A": {3, 0, 2}, "B": {0, 0, 5}, "C": {1, 0, 0}}, values)
+	assert.Equal(t, map[string]int64{"A": 5, "B": 5, "C": 1}, totals)
+}
+
+func TestIntervalSeriesFloatsAndGauges(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	assertAggregate := func(s *vkutil.IntervalSeries, f string, agg vkutil.Aggregation, expected float64) {
+		actual, err := s.Aggregate(ctx, rc, f, agg)
+		assert.NoError(t, err)
+		assert.InDelta(t, expected, actual, 0.0001, "%s of field %s mismatch", agg, f)
+	}
+
+	series := vkutil.NewIntervalSeries("foos", time.Minute*5, 3)
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 3, 234567, time.UTC))
+	assert.NoError(t, series.RecordFloat(ctx, rc, "latency", 1.5))
+	assert.NoError(t, series.RecordFloat(ctx, rc, "latency", 0.25))
+	assert.NoError(t, series.RecordGauge(ctx, rc, "depth", 10))
+	assert.NoError(t, series.RecordGauge(ctx, rc, "depth", 7))
+
+	assertvk.HGetAll(t, rc, "foos:2021-11-18T12:00", map[string]string{"latency": "1.75", "depth": "7"})
+
+	setNow(time.Date(2021, 11, 18, 12, 11, 3, 234567, time.UTC))
+	assert.NoError(t, series.RecordFloat(ctx, rc, "latency", 0.5))
+	assert.NoError(t, series.RecordGauge(ctx, rc, "depth", 12.5))
+
+	vals, err := series.GetFloat(ctx, rc, "latency")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 0, 1.75}, vals)
+
+	vals, err = series.GetFloat(ctx, rc, "depth")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{12.5, 0, 7}, vals)
+
+	assertAggregate(series, "latency", vkutil.AggregateSum, 2.25)
+	assertAggregate(series, "latency", vkutil.AggregateMax, 1.75)
+	assertAggregate(series, "latency", vkutil.AggregateMin, 0.5) // empty intervals are ignored
+	assertAggregate(series, "latency", vkutil.AggregateLast, 0.5)
+	assertAggregate(series, "depth", vkutil.AggregateMax, 12.5)
+	assertAggregate(series, "depth", vkutil.AggregateMin, 7)
+	assertAggregate(series, "depth", vkutil.AggregateLast, 12.5)
+	assertAggregate(series, "other", vkutil.AggregateSum, 0)
+	assertAggregate(series, "other", vkutil.AggregateMax, 0)
+	assertAggregate(series, "other", vkutil.AggregateLast, 0)
+
+	_, err = series.Aggregate(ctx, rc, "other", "avg")
+	assert.EqualError(t, err, "unknown aggregation: avg")
+	// series with a mix of integer and float fields can only be fetched as floats
+	assert.NoError(t, series.Record(ctx, rc, "count", 3))
+
+	_, _, err = series.GetAll(ctx, rc)
+	assert.Error(t, err)
+
+	values, totals, err := series.GetAllFloat(ctx, rc)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]float64{"latency": {0.5, 0, 1.75}, "depth": {12.5, 0, 7}, "count": {3, 0, 0}}, values)
+	assert.Equal(t, map[string]float64{"latency": 2.25, "depth": 19.5, "count": 3}, totals)
+}
+
+func TestIntervalSeriesRateAndAverage(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	assertRate := func(s *vkutil.IntervalSeries, f string, expected float64) {
+		actual, err := s.Rate(ctx, rc, f)
+		assert.NoError(t, err)
+		assert.InDelta(t, expected, actual, 0.0001, "rate of field %s mismatch", f)
+	}
+	assertAverage := func(s *vkutil.IntervalSeries, f string, weights []float64, expected float64) {
+		actual, err := s.MovingAverage(ctx, rc, f, weights...)
+		assert.NoError(t, err)
+		assert.InDelta(t, expected, actual, 0.0001, "moving average of field %s mismatch", f)
+	}
+
+	series := vkutil.NewIntervalSeries("foos", time.Minute, 3)
+
+	setNow(time.Date(2021, 11, 18, 12, 0, 30, 0, time.UTC))
+	series.Record(ctx, rc, "A", 60)
+
+	setNow(time.Date(2021, 11, 18, 12, 1, 30, 0, time.UTC))
+	series.Record(ctx, rc, "A", 90)
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 15, 0, time.UTC))
+	series.Record(ctx, rc, "A", 15)
+	series.RecordFloat(ctx, rc, "B", 1.5)
+
+	assertRate(series, "A", 165.0/135.0) // 2 full minutes + 15 seconds of current minute
+	assertRate(series, "B", 1.5/135.0)
+	assertRate(series, "C", 0)
+
+	// default weights are 3, 2, 1
+	assertAverage(series, "A", nil, (3*15+2*90+1*60)/6.0)
+	assertAverage(series, "A", []float64{0, 1, 1}, 75)
+	assertAverage(series, "A", []float64{1, 1}, 52.5)
+	assertAverage(series, "B", []float64{1}, 1.5)
+	assertAverage(series, "C", nil, 0)
+	assertAverage(series, "A", []float64{0, 0}, 0)
+
+	_, err := series.MovingAverage(ctx, rc, "A", 1, 1, 1, 1)
+	assert.EqualError(t, err, "can't have more weights than intervals (3)")
+
+	// single interval series at the very start of its interval
+	series = vkutil.NewIntervalSeries("bars", time.Minute, 1)
+	setNow(time.Date(2021, 11, 18, 12, 3, 0, 0, time.UTC))
+	series.Record(ctx, rc, "A", 10)
+
+	assertRate(series, "A", 0)
+}
+
+func TestIntervalSeriesRollup(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	assertRollup := func(src, dst *vkutil.IntervalSeries, expected int) {
+		actual, err := src.Rollup(ctx, rc, dst)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "rolled up intervals mismatch")
+	}
+
+	minutely := vkutil.NewIntervalSeries("foos", time.Minute, 3)
+	hourly := vkutil.NewIntervalSeries("foos_hourly", time.Hour, 24)
+
+	setNow(time.Date(2021, 11, 18, 12, 58, 30, 0, time.UTC))
+	minutely.Record(ctx, rc, "A", 2)
+	minutely.RecordFloat(ctx, rc, "B", 1.5)
+
+	setNow(time.Date(2021, 11, 18, 12, 59, 30, 0, time.UTC))
+	minutely.Record(ctx, rc, "A", 3)
+
+	setNow(time.Date(2021, 11, 18, 13, 0, 30, 0, time.UTC))
+	minutely.Record(ctx, rc, "A", 4)
+
+	assertRollup(minutely, hourly, 2) // current minute isn't rolled up
+
+	assertvk.HGetAll(t, rc, "foos_hourly:2021-11-18T12:00", map[string]string{"A": "5", "B": "1.5"})
+	assertvk.Get(t, rc, "foos_hourly:rollup:foos", "2021-11-18T12:59")
+
+	// rolling up again is a noop
+	assertRollup(minutely, hourly, 0)
+
+	assertvk.HGetAll(t, rc, "foos_hourly:2021-11-18T12:00", map[string]string{"A": "5", "B": "1.5"})
+
+	setNow(time.Date(2021, 11, 18, 13, 2, 30, 0, time.UTC))
+	minutely.Record(ctx, rc, "A", 1)
+
+	assertRollup(minutely, hourly, 2)
+
+	assertvk.HGetAll(t, rc, "foos_hourly:2021-11-18T12:00", map[string]string{"A": "5", "B": "1.5"})
+	assertvk.HGetAll(t, rc, "foos_hourly:2021-11-18T13:00", map[string]string{"A": "4"})
+
+	vals, err := hourly.Get(ctx, rc, "A")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{4, 5}, vals[:2])
+
+	_, err = hourly.Rollup(ctx, rc, minutely)
+	assert.EqualError(t, err, "can't rollup 1h0m0s intervals into 1m0s intervals")
+
+	_, err = minutely.Rollup(ctx, rc, vkutil.NewIntervalSeries("bars", time.Second*90, 3))
+	assert.EqualError(t, err, "can't rollup 1m0s intervals into 1m30s intervals")
+}
+
+func TestIntervalSeriesTop(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	assertTop := func(s *vkutil.IntervalSeries, n int, expectedFields []string, expectedTotals []float64) {
+		actualFields, actualTotals, err := s.Top(ctx, rc, n)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedFields, actualFields)
+		assert.Equal(t, expectedTotals, actualTotals)
+	}
+
+	series := vkutil.NewIntervalSeries("foos", time.Minute*5, 3)
+
+	assertTop(series, 3, []string{}, []float64{})
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 3, 234567, time.UTC))
+	series.Record(ctx, rc, "A", 2)
+	series.Record(ctx, rc, "B", 5)
+	series.Record(ctx, rc, "C", 1)
+
+	setNow(time.Date(2021, 11, 18, 12, 11, 3, 234567, time.UTC))
+	series.Record(ctx, rc, "A", 4)
+	series.RecordFloat(ctx, rc, "D", 0.5)
+	series.Record(ctx, rc, "E", 1234567890123456)
+
+	assertTop(series, 3, []string{"E", "A", "B"}, []float64{1234567890123456, 6, 5})
+	assertTop(series, 10, []string{"E", "A", "B", "C", "D"}, []float64{1234567890123456, 6, 5, 1, 0.5})
+	assertTop(series, 0, []string{}, []float64{})
+
+	// ties are ordered by field name
+	series.Record(ctx, rc, "C", 5)
+
+	assertTop(series, 4, []string{"E", "A", "C", "B"}, []float64{1234567890123456, 6, 6, 5})
+}
+
+func TestIntervalSeriesSlidingTotal(t *testing.T) {
+	ctx := context.Background()
+	rp := assertvk.TestDB()
+	rc := rp.Get()
+	defer rc.Close()
+
+	defer assertvk.FlushDB()
+
+	defer dates.SetNowFunc(time.Now)
+	setNow := func(d time.Time) { dates.SetNowFunc(dates.NewFixedNow(d)) }
+
+	assertSlidingTotal := func(s *vkutil.IntervalSeries, f string, expected float64) {
+		actual, err := s.SlidingTotal(ctx, rc, f)
+		assert.NoError(t, err)
+		assert.InDelta(t, expected, actual, 0.0001, "sliding total of field %s mismatch", f)
+	}
+
+	series := vkutil.NewIntervalSeries("foos", time.Minute, 3)
+
+	setNow(time.Date(2021, 11, 18, 12, 0, 30, 0, time.UTC))
+	series.Record(ctx, rc, "A", 60)
+
+	setNow(time.Date(2021, 11, 18, 12, 1, 30, 0, time.UTC))
+	series.Record(ctx, rc, "A", 30)
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 0, 0, time.UTC))
+	series.Record(ctx, rc, "A", 10)
+
+	// at the start of the current interval, all of the oldest interval is inside the window
+	assertSlidingTotal(series, "A", 100)
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 15, 0, time.UTC))
+	assertSlidingTotal(series, "A", 10+30+45)
+
+	setNow(time.Date(2021, 11, 18, 12, 2, 45, 0, time.UTC))
+	assertSlidingTotal(series, "A", 10+30+15)
+
+	assertSlidingTotal(series, "B", 0)
+
+	_, err := vkutil.NewIntervalSeries("bars", time.Minute, 1).SlidingTotal(ctx, rc, "A")
+	assert.EqualError(t, err, "sliding window requires at least 2 intervals")
+}
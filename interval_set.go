@@ -16,16 +16,18 @@ type IntervalSet struct {
 }
 
 // NewIntervalSet creates a new empty interval set
-func NewIntervalSet(keyBase string, interval time.Duration, size int) *IntervalSet {
-	return &IntervalSet{keyBase: keyBase, interval: interval, size: size}
+func NewIntervalSet(keyBase string, interval time.Duration, size int, options ...IntervalOption) *IntervalSet {
+	return &IntervalSet{keyBase: intervalKeyBase(keyBase, options), interval: interval, size: size}
 }
 
 //go:embed lua/iset_ismember.lua
 var isetIsMember string
-var isetIsMemberScript = redis.NewScript(-1, isetIsMember)
+var isetIsMemberScript = newReadScript(isetIsMember)
 
 // IsMember returns whether we contain the given value
 func (s *IntervalSet) IsMember(ctx context.Context, rc redis.Conn, member string) (bool, error) {
+	ctx = withOperation(ctx, "IntervalSet.IsMember", true)
+
 	keys := s.keys()
 
 	return redis.Bool(isetIsMemberScript.DoContext(ctx, rc, redis.Args{}.Add(len(keys)).AddFlat(keys).Add(member)...))
@@ -33,6 +35,8 @@ func (s *IntervalSet) IsMember(ctx context.Context, rc redis.Conn, member string
 
 // Add adds the given value
 func (s *IntervalSet) Add(ctx context.Context, rc redis.Conn, member string) error {
+	ctx = withOperation(ctx, "IntervalSet.Add", true)
+
 	key := s.keys()[0]
 
 	rc.Send("MULTI")
@@ -44,6 +48,8 @@ func (s *IntervalSet) Add(ctx context.Context, rc redis.Conn, member string) err
 
 // Rem removes the given values
 func (s *IntervalSet) Rem(ctx context.Context, rc redis.Conn, members ...string) error {
+	ctx = withOperation(ctx, "IntervalSet.Rem", true)
+
 	rc.Send("MULTI")
 	for _, k := range s.keys() {
 		rc.Send("SREM", redis.Args{}.Add(k).AddFlat(members)...)
@@ -54,6 +60,8 @@ func (s *IntervalSet) Rem(ctx context.Context, rc redis.Conn, members ...string)
 
 // Clear removes all values
 func (s *IntervalSet) Clear(ctx context.Context, rc redis.Conn) error {
+	ctx = withOperation(ctx, "IntervalSet.Clear", true)
+
 	rc.Send("MULTI")
 	for _, k := range s.keys() {
 		rc.Send("DEL", k)
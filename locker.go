@@ -25,6 +25,8 @@ func NewLocker(key string, expiration time.Duration) *Locker {
 // It will retry every second until the retry period has ended, returning empty string if not
 // acquired in that time.
 func (l *Locker) Grab(ctx context.Context, rp *redis.Pool, retry time.Duration) (string, error) {
+	ctx = withOperation(ctx, "Locker.Grab", false)
+
 	value := RandomBase64(10)                  // generate our lock value
 	expires := int(l.expiration / time.Second) // convert our expiration to seconds
 
@@ -58,6 +60,8 @@ var lockerReleaseScript = redis.NewScript(1, lockerRelease)
 // Release releases this lock if the given lock value is correct (i.e we own this lock). It is not an
 // error to release a lock that is no longer present.
 func (l *Locker) Release(ctx context.Context, rp *redis.Pool, value string) error {
+	ctx = withOperation(ctx, "Locker.Release", true)
+
 	rc := rp.Get()
 	defer rc.Close()
 
@@ -72,6 +76,8 @@ var lockerExtendScript = redis.NewScript(1, lockerExtend)
 
 // Extend extends our lock expiration by the passed in number of seconds provided the lock value is correct
 func (l *Locker) Extend(ctx context.Context, rp *redis.Pool, value string, expiration time.Duration) error {
+	ctx = withOperation(ctx, "Locker.Extend", true)
+
 	rc := rp.Get()
 	defer rc.Close()
 
@@ -84,10 +90,12 @@ func (l *Locker) Extend(ctx context.Context, rp *redis.Pool, value string, expir
 
 // IsLocked returns whether this lock is currently held by any process.
 func (l *Locker) IsLocked(ctx context.Context, rp *redis.Pool) (bool, error) {
+	ctx = withOperation(ctx, "Locker.IsLocked", true)
+
 	rc := rp.Get()
 	defer rc.Close()
 
-	exists, err := redis.Bool(redis.DoContext(rc, ctx, "EXISTS", l.key))
+	exists, err := redis.Bool(redis.DoContext(rc, readOnly(ctx), "EXISTS", l.key))
 	if err != nil {
 		return false, err
 	}
@@ -1,9 +1,71 @@
-local key, score, member, cap, expire = KEYS[1], ARGV[1], ARGV[2], tonumber(ARGV[3]), ARGV[4]
+local key, orderKey = KEYS[1], KEYS[2]
+local cap, expire, eviction, incr = tonumber(ARGV[1]), ARGV[2], ARGV[3], ARGV[4]
+
+-- track insertion order by giving each member added a sequence greater than the newest
+local seq = 1
+if eviction == "oldest" then
+	local newest = redis.call("ZREVRANGE", orderKey, 0, 0, "WITHSCORES")
+	if #newest > 0 then
+		seq = tonumber(newest[2]) + 1
+	end
+end
+
+-- remaining args are pairs of scores and members
+local members, scores = {}, {}
+
+for i = 5, #ARGV, 2 do
+	local score, member = ARGV[i], ARGV[i + 1]
+
+	if incr == "1" then
+		score = redis.call("ZADD", key, "INCR", score, member)
+	else
+		redis.call("ZADD", key, score, member)
+	end
+
+	if eviction == "oldest" then
+		redis.call("ZADD", orderKey, seq, member)
+		seq = seq + 1
+	end
+
+	table.insert(members, member)
+	table.insert(scores, score)
+end
 
-redis.call("ZADD", key, score, member)
 redis.call("EXPIRE", key, expire)
+if eviction == "oldest" then
+	redis.call("EXPIRE", orderKey, expire)
+end
+
 local newSize = redis.call("ZCARD", key)
 
 if newSize > cap then
-	redis.call("ZREMRANGEBYRANK", key, 0, (newSize - cap) - 1)
-end
\ No newline at end of file
+	local excess = newSize - cap
+
+	if eviction == "oldest" then
+		local oldest = redis.call("ZRANGE", orderKey, 0, excess - 1)
+
+		-- remove in chunks to stay within the limit on how many values unpack can return
+		for i = 1, #oldest, 1000 do
+			local j = math.min(i + 999, #oldest)
+			redis.call("ZREM", key, unpack(oldest, i, j))
+			redis.call("ZREM", orderKey, unpack(oldest, i, j))
+		end
+	elseif eviction == "highest" then
+		redis.call("ZREMRANGEBYRANK", key, -excess, -1)
+	else
+		redis.call("ZREMRANGEBYRANK", key, 0, excess - 1)
+	end
+end
+
+-- return whether each member survived and its new score
+local result = {}
+for i, member in ipairs(members) do
+	if redis.call("ZSCORE", key, member) then
+		table.insert(result, 1)
+	else
+		table.insert(result, 0)
+	end
+	table.insert(result, scores[i])
+end
+
+return result
\ No newline at end of file
@@ -0,0 +1,7 @@
+local values = {}
+
+for _, key in ipairs(KEYS) do
+	table.insert(values, redis.call("HGETALL", key))
+end
+
+return values
\ No newline at end of file
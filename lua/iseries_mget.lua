@@ -0,0 +1,8 @@
+local fields = ARGV
+local values = {}
+
+for _, key in ipairs(KEYS) do
+	table.insert(values, redis.call("HMGET", key, unpack(fields)))
+end
+
+return values
\ No newline at end of file
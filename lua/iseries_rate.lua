@@ -0,0 +1,15 @@
+local field, interval, elapsed = ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3])
+local total = 0
+
+for _, key in ipairs(KEYS) do
+	total = total + (tonumber(redis.call("HGET", key, field)) or 0)
+end
+
+-- the window covers all previous intervals fully but only the elapsed part of the current interval
+local duration = (#KEYS - 1) * interval + elapsed
+if duration <= 0 then
+	return "0"
+end
+
+-- return as string as numbers are converted to integers
+return string.format("%.17g", total / duration)
\ No newline at end of file
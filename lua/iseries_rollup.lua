@@ -0,0 +1,27 @@
+local dstExpire, checkpointExpire = ARGV[1], ARGV[2]
+local last = redis.call("GET", KEYS[1]) or ""
+local rolled = 0
+
+-- keys after the checkpoint key are pairs of source and destination keys, oldest first
+for i = 2, #KEYS, 2 do
+	local timestamp = ARGV[2 + i / 2]
+
+	if timestamp > last then
+		local srcKey, dstKey = KEYS[i], KEYS[i + 1]
+		local vals = redis.call("HGETALL", srcKey)
+
+		for j = 1, #vals, 2 do
+			redis.call("HINCRBYFLOAT", dstKey, vals[j], vals[j + 1])
+		end
+		if #vals > 0 then
+			redis.call("EXPIRE", dstKey, dstExpire)
+		end
+
+		last = timestamp
+		rolled = rolled + 1
+	end
+end
+
+redis.call("SET", KEYS[1], last, "EX", checkpointExpire)
+
+return rolled
\ No newline at end of file
@@ -0,0 +1,16 @@
+local field, oldestWeight = ARGV[1], tonumber(ARGV[2])
+local total = 0
+
+for i, key in ipairs(KEYS) do
+	local value = tonumber(redis.call("HGET", key, field)) or 0
+
+	-- only part of the oldest interval is still inside the window
+	if i == #KEYS then
+		value = value * oldestWeight
+	end
+
+	total = total + value
+end
+
+-- return as string as numbers are converted to integers
+return string.format("%.17g", total)
\ No newline at end of file
@@ -0,0 +1,31 @@
+local n = tonumber(ARGV[1])
+local totals = {}
+
+for _, key in ipairs(KEYS) do
+	local vals = redis.call("HGETALL", key)
+
+	for i = 1, #vals, 2 do
+		totals[vals[i]] = (totals[vals[i]] or 0) + tonumber(vals[i + 1])
+	end
+end
+
+local fields = {}
+for field in pairs(totals) do
+	table.insert(fields, field)
+end
+
+-- sort by total descending, then by field name so that ties are deterministic
+table.sort(fields, function(a, b)
+	if totals[a] ~= totals[b] then
+		return totals[a] > totals[b]
+	end
+	return a < b
+end)
+
+local result = {}
+for i = 1, math.min(n, #fields) do
+	table.insert(result, fields[i])
+	table.insert(result, string.format("%.17g", totals[fields[i]]))
+end
+
+return result
\ No newline at end of file
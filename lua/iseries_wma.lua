@@ -0,0 +1,15 @@
+local field = ARGV[1]
+local sum, weights = 0, 0
+
+for i, key in ipairs(KEYS) do
+	local weight = tonumber(ARGV[i + 1])
+	sum = sum + weight * (tonumber(redis.call("HGET", key, field)) or 0)
+	weights = weights + weight
+end
+
+if weights == 0 then
+	return "0"
+end
+
+-- return as string as numbers are converted to integers
+return string.format("%.17g", sum / weights)
\ No newline at end of file
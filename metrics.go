@@ -0,0 +1,165 @@
+package vkutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// LatencyBuckets are the default upper bounds of the buckets used for command latency histograms. They're copied
+// when metrics are created, so changing them only affects metrics created afterwards.
+var LatencyBuckets = []time.Duration{
+	500 * time.Microsecond, time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond,
+}
+
+// PoolStats are statistics for a pool
+type PoolStats struct {
+	redis.PoolStats
+
+	DialErrors int64
+	Commands   map[string]CommandStats
+}
+
+// CommandStats are statistics for a command
+type CommandStats struct {
+	Count    int64
+	Errors   int64
+	Duration time.Duration // total time spent on this command
+	Buckets  []int64       // cumulative number of calls within each latency bucket
+}
+
+// PoolMetrics records metrics for a pool created with the WithMetrics option
+type PoolMetrics struct {
+	mutex      sync.Mutex
+	pool       *redis.Pool
+	buckets    []time.Duration
+	dialErrors int64
+	commands   map[string]*CommandStats
+}
+
+// NewPoolMetrics creates a new set of pool metrics using the current LatencyBuckets
+func NewPoolMetrics() *PoolMetrics {
+	return &PoolMetrics{buckets: slices.Clone(LatencyBuckets), commands: make(map[string]*CommandStats)}
+}
+
+// WithMetrics configures the pool to record metrics to the given metrics
+func WithMetrics(m *PoolMetrics) PoolOption {
+	return func(c *poolConfig) { c.metrics = m }
+}
+
+// Stats returns a snapshot of the current statistics
+func (m *PoolMetrics) Stats() PoolStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats := PoolStats{DialErrors: m.dialErrors, Commands: make(map[string]CommandStats, len(m.commands))}
+	if m.pool != nil {
+		stats.PoolStats = m.pool.Stats()
+	}
+	for name, c := range m.commands {
+		stats.Commands[name] = CommandStats{Count: c.Count, Errors: c.Errors, Duration: c.Duration, Buckets: slices.Clone(c.Buckets)}
+	}
+	return stats
+}
+
+// Handler returns an HTTP handler which writes the current statistics in the Prometheus text exposition format
+func (m *PoolMetrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.Stats().writeTo(w, m.buckets)
+	})
+}
+
+func (s PoolStats) writeTo(w io.Writer, buckets []time.Duration) {
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+
+	metric("vkutil_pool_active_connections", "gauge", "Number of connections in the pool, idle or in use.", s.ActiveCount)
+	metric("vkutil_pool_idle_connections", "gauge", "Number of idle connections in the pool.", s.IdleCount)
+	metric("vkutil_pool_wait_count_total", "counter", "Total number of connections waited for.", s.WaitCount)
+	metric("vkutil_pool_wait_duration_seconds_total", "counter", "Total time spent waiting for connections.", s.WaitDuration.Seconds())
+	metric("vkutil_pool_dial_errors_total", "counter", "Total number of failed dials.", s.DialErrors)
+
+	names := make([]string, 0, len(s.Commands))
+	for name := range s.Commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	fmt.Fprint(w, "# HELP vkutil_command_duration_seconds Latency of commands.\n# TYPE vkutil_command_duration_seconds histogram\n")
+	for _, name := range names {
+		c := s.Commands[name]
+		for i, b := range buckets {
+			fmt.Fprintf(w, "vkutil_command_duration_seconds_bucket{command=%q,le=\"%v\"} %d\n", name, b.Seconds(), c.Buckets[i])
+		}
+		fmt.Fprintf(w, "vkutil_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", name, c.Count)
+		fmt.Fprintf(w, "vkutil_command_duration_seconds_sum{command=%q} %v\n", name, c.Duration.Seconds())
+		fmt.Fprintf(w, "vkutil_command_duration_seconds_count{command=%q} %d\n", name, c.Count)
+	}
+
+	fmt.Fprint(w, "# HELP vkutil_command_errors_total Total number of commands which returned errors.\n# TYPE vkutil_command_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "vkutil_command_errors_total{command=%q} %d\n", name, s.Commands[name].Errors)
+	}
+}
+
+func (m *PoolMetrics) recordDial(err error) {
+	if err != nil {
+		m.mutex.Lock()
+		m.dialErrors++
+		m.mutex.Unlock()
+	}
+}
+
+func (m *PoolMetrics) recordCommand(name string, d time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c := m.commands[name]
+	if c == nil {
+		c = &CommandStats{Buckets: make([]int64, len(m.buckets))}
+		m.commands[name] = c
+	}
+
+	c.Count++
+	c.Duration += d
+	if err != nil {
+		c.Errors++
+	}
+	for i, b := range m.buckets {
+		if d <= b {
+			c.Buckets[i]++
+		}
+	}
+}
+
+func (m *PoolMetrics) attach(rp *redis.Pool) {
+	m.mutex.Lock()
+	m.pool = rp
+	m.mutex.Unlock()
+}
+
+// hook which records the latency of each command
+type metricsHook struct {
+	metrics *PoolMetrics
+}
+
+func (h *metricsHook) BeforeCommand(ctx context.Context, cmd *CommandInfo) context.Context {
+	return ctx
+}
+
+func (h *metricsHook) AfterCommand(ctx context.Context, cmd *CommandInfo) {
+	if cmd.Name == "" {
+		return // flushes of pipelined commands don't have a single command to record them against
+	}
+	h.metrics.recordCommand(cmd.Name, cmd.Duration, cmd.Err)
+}
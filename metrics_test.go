@@ -0,0 +1,83 @@
+package vkutil_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	metrics := vkutil.NewPoolMetrics()
+
+	rp, err := vkutil.NewPool("redis://valkey8:6379/15", vkutil.WithMetrics(metrics))
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	_, err = redis.DoContext(rc, ctx, "SET", "test_metrics", "1")
+	assert.NoError(t, err)
+	_, err = redis.DoContext(rc, ctx, "get", "test_metrics")
+	assert.NoError(t, err)
+	_, err = redis.DoContext(rc, ctx, "INCR", "test_metrics", "2") // wrong number of args
+	assert.Error(t, err)
+	_, err = redis.DoContext(rc, ctx, "DEL", "test_metrics")
+	assert.NoError(t, err)
+
+	stats := metrics.Stats()
+	assert.Equal(t, 1, stats.ActiveCount)
+	assert.Equal(t, 0, stats.IdleCount)
+	assert.Equal(t, int64(0), stats.DialErrors)
+	assert.Len(t, stats.Commands, 5)
+	assert.Equal(t, int64(1), stats.Commands["GET"].Count)
+	assert.Equal(t, int64(0), stats.Commands["GET"].Errors)
+	assert.Equal(t, int64(1), stats.Commands["INCR"].Errors)
+	assert.Len(t, stats.Commands["SET"].Buckets, len(vkutil.LatencyBuckets))
+	assert.Equal(t, int64(1), stats.Commands["SET"].Buckets[len(vkutil.LatencyBuckets)-1])
+
+	rc.Close()
+
+	stats = metrics.Stats()
+	assert.Equal(t, 1, stats.ActiveCount)
+	assert.Equal(t, 1, stats.IdleCount)
+
+	// changing the default buckets doesn't affect existing metrics
+	defaultBuckets := vkutil.LatencyBuckets
+	vkutil.LatencyBuckets = []time.Duration{time.Millisecond}
+	defer func() { vkutil.LatencyBuckets = defaultBuckets }()
+
+	rc = rp.Get()
+	_, err = redis.DoContext(rc, ctx, "EXISTS", "test_metrics")
+	assert.NoError(t, err)
+	rc.Close()
+	assert.Len(t, metrics.Stats().Commands["EXISTS"].Buckets, len(defaultBuckets))
+
+	// failed dials are counted
+	failing := vkutil.NewPoolMetrics()
+	_, err = vkutil.NewPool("redis://localhost:1/15", vkutil.WithMetrics(failing), vkutil.WithDialTimeout(time.Second))
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), failing.Stats().DialErrors)
+
+	// check Prometheus output
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4", w.Header().Get("Content-Type"))
+
+	body, _ := io.ReadAll(w.Body)
+	assert.Contains(t, string(body), "# TYPE vkutil_pool_active_connections gauge\nvkutil_pool_active_connections 1\n")
+	assert.Contains(t, string(body), "# TYPE vkutil_pool_idle_connections gauge\nvkutil_pool_idle_connections 1\n")
+	assert.Contains(t, string(body), "vkutil_pool_wait_count_total 0\n")
+	assert.Contains(t, string(body), "vkutil_pool_dial_errors_total 0\n")
+	assert.Contains(t, string(body), "# TYPE vkutil_command_duration_seconds histogram\n")
+	assert.Contains(t, string(body), "vkutil_command_duration_seconds_bucket{command=\"GET\",le=\"2.5\"} 1\n")
+	assert.Contains(t, string(body), "vkutil_command_duration_seconds_bucket{command=\"GET\",le=\"+Inf\"} 1\n")
+	assert.Contains(t, string(body), "vkutil_command_duration_seconds_count{command=\"PING\"} 1\n")
+	assert.Contains(t, string(body), "vkutil_command_errors_total{command=\"INCR\"} 1\n")
+}
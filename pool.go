@@ -1,75 +1,487 @@
 package vkutil
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/url"
+	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+// library name and module path reported with CLIENT SETINFO
+const (
+	libName   = "vkutil"
+	libModule = "github.com/nyaruka/vkutil"
+)
+
+// PoolOption is an option passed to NewPool
+type PoolOption func(*poolConfig)
+
+// CredentialsProvider provides the username and password used to authenticate each new connection, e.g. to support
+// rotating passwords. An empty username authenticates as the default user.
+type CredentialsProvider func(ctx context.Context) (username, password string, err error)
+
+type poolConfig struct {
+	maxActive   int
+	maxIdle     int
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	healthCheck     bool
+	healthCheckIdle time.Duration
+
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	clientName   string
+	db           int
+	noSelect     bool
+
+	network     string
+	address     string
+	dialOptions []redis.DialOption
+
+	tlsConfig     *tls.Config
+	tlsCAFile     string
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsServerName string
+
+	credentials CredentialsProvider
+
+	replicaURLs []string
+	metrics     *PoolMetrics
+	hooks       []Hook
+	retry       *retryConfig
+	breaker     *circuitBreaker
+
+	customizers []func(*redis.Pool)
+}
+
+// WithClientName configures the name set with CLIENT SETNAME on each new connection, e.g. the name of your service, so
+// that connections can be identified in CLIENT LIST
+func WithClientName(v string) PoolOption {
+	return func(c *poolConfig) { c.clientName = v }
+}
+
+// WithPool configures a function which is called with the pool once it's created, e.g. to set fields of redis.Pool
+// which don't have their own option. Pool options used to be of this type, so they can be converted with this.
+func WithPool(fn func(*redis.Pool)) PoolOption {
+	return func(c *poolConfig) { c.customizers = append(c.customizers, fn) }
+}
+
 // WithMaxActive configures maximum number of concurrent connections to allow
-func WithMaxActive(v int) func(*redis.Pool) {
-	return func(rp *redis.Pool) { rp.MaxActive = v }
+func WithMaxActive(v int) PoolOption {
+	return func(c *poolConfig) { c.maxActive = v }
 }
 
 // WithMaxIdle configures the maximum number of idle connections to keep
-func WithMaxIdle(v int) func(*redis.Pool) {
-	return func(rp *redis.Pool) { rp.MaxIdle = v }
+func WithMaxIdle(v int) PoolOption {
+	return func(c *poolConfig) { c.maxIdle = v }
 }
 
 // WithIdleTimeout configures how long to wait before reaping a connection
-func WithIdleTimeout(v time.Duration) func(*redis.Pool) {
-	return func(rp *redis.Pool) { rp.IdleTimeout = v }
+func WithIdleTimeout(v time.Duration) PoolOption {
+	return func(c *poolConfig) { c.idleTimeout = v }
+}
+
+// WithMaxConnLifetime configures how long a connection can be used for before it's closed
+func WithMaxConnLifetime(v time.Duration) PoolOption {
+	return func(c *poolConfig) { c.maxLifetime = v }
+}
+
+// WithHealthCheck configures connections to be tested with a PING when they are borrowed from the pool, if they've been
+// idle for longer than the given duration, so zero means they are always tested. Connections which fail are closed and
+// replaced with new ones.
+func WithHealthCheck(idle time.Duration) PoolOption {
+	return func(c *poolConfig) { c.healthCheck, c.healthCheckIdle = true, idle }
 }
 
-// NewPool creates a new pool with the given options
-func NewPool(redisURL string, options ...func(*redis.Pool)) (*redis.Pool, error) {
+// WithDialTimeout configures the timeout for connecting to the server
+func WithDialTimeout(v time.Duration) PoolOption {
+	return func(c *poolConfig) { c.dialTimeout = v }
+}
+
+// WithReadTimeout configures the timeout for reading a reply from the server
+func WithReadTimeout(v time.Duration) PoolOption {
+	return func(c *poolConfig) { c.readTimeout = v }
+}
+
+// WithWriteTimeout configures the timeout for writing a command to the server
+func WithWriteTimeout(v time.Duration) PoolOption {
+	return func(c *poolConfig) { c.writeTimeout = v }
+}
+
+// WithTLSConfig configures the TLS config to use for rediss:// and valkeys:// URLs
+func WithTLSConfig(v *tls.Config) PoolOption {
+	return func(c *poolConfig) { c.tlsConfig = v }
+}
+
+// WithTLSCAFile configures a PEM encoded CA bundle to verify the server certificate against
+func WithTLSCAFile(path string) PoolOption {
+	return func(c *poolConfig) { c.tlsCAFile = path }
+}
+
+// WithTLSClientCert configures a PEM encoded client certificate and key to present to the server
+func WithTLSClientCert(certFile, keyFile string) PoolOption {
+	return func(c *poolConfig) { c.tlsCertFile, c.tlsKeyFile = certFile, keyFile }
+}
+
+// WithTLSServerName configures the server name used to verify the server certificate, if it differs from the host
+func WithTLSServerName(v string) PoolOption {
+	return func(c *poolConfig) { c.tlsServerName = v }
+}
+
+// WithCredentials configures a provider of credentials to use instead of any in the URL
+func WithCredentials(p CredentialsProvider) PoolOption {
+	return func(c *poolConfig) { c.credentials = p }
+}
+
+// WithNoSelect configures connections to never send SELECT, for proxies and clusters which reject it
+func WithNoSelect() PoolOption {
+	return func(c *poolConfig) { c.noSelect = true }
+}
+
+// NewPool creates a new pool with the given options. URLs with the rediss:// or valkeys:// schemes connect using TLS,
+// and URLs with the unix:// scheme connect to the unix socket at the URL path. Settings can also be read from URL query
+// parameters, i.e. db, dial_timeout, read_timeout, write_timeout, max_active, max_idle, idle_timeout and client_name,
+// but are overridden by any options. Other parameters are ignored, except protocol which can only be 2 as connections
+// always use RESP2.
+func NewPool(redisURL string, options ...PoolOption) (*redis.Pool, error) {
+	cfg, err := newPoolConfig(redisURL, options)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := cfg.dialer(func(context.Context) (string, error) { return cfg.address, nil })
+
+	if len(cfg.replicaURLs) > 0 {
+		replicas, err := cfg.replicas(options)
+		if err != nil {
+			return nil, err
+		}
+		dial = replicas.wrap(dial)
+	}
+
+	rp := cfg.build(dial)
+	cfg.customize(rp)
+
+	if err := checkPool(rp); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// creates the config for a new pool from the given URL and options
+func newPoolConfig(redisURL string, options []PoolOption) (*poolConfig, error) {
 	parsedURL, err := url.Parse(redisURL)
 	if err != nil {
 		return nil, err
 	}
 
-	dial := func() (redis.Conn, error) {
-		conn, err := redis.Dial("tcp", parsedURL.Host)
+	cfg := &poolConfig{maxActive: 32, maxIdle: 4, idleTimeout: 180 * time.Second, network: "tcp", address: parsedURL.Host}
+
+	// unix socket URLs use the path for the socket rather than the database
+	if parsedURL.Scheme == "unix" {
+		if parsedURL.Path == "" {
+			return nil, errors.New("missing socket path in URL")
+		}
+		cfg.network, cfg.address = "unix", parsedURL.Path
+	} else if err := cfg.parsePath(parsedURL.Path); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.parseQuery(parsedURL.Query()); err != nil {
+		return nil, err
+	}
+
+	for _, o := range options {
+		o(cfg)
+	}
+
+	if cfg.noSelect && cfg.db != 0 {
+		return nil, fmt.Errorf("can't use database %d when SELECT is disabled", cfg.db)
+	}
+
+	cfg.dialOptions = cfg.timeouts()
+
+	switch parsedURL.Scheme {
+	case "redis", "valkey", "unix":
+	case "rediss", "valkeys":
+		tlsConfig, err := cfg.tls()
+		if err != nil {
+			return nil, err
+		}
+		cfg.dialOptions = append(cfg.dialOptions, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme: %s", parsedURL.Scheme)
+	}
+
+	if cfg.credentials == nil {
+		cfg.credentials = urlCredentials(parsedURL)
+	}
+
+	return cfg, nil
+}
+
+// gets dial options for the configured timeouts
+func (c *poolConfig) timeouts() []redis.DialOption {
+	opts := []redis.DialOption{redis.DialReadTimeout(c.readTimeout), redis.DialWriteTimeout(c.writeTimeout)}
+	if c.dialTimeout > 0 {
+		opts = append(opts, redis.DialConnectTimeout(c.dialTimeout)) // otherwise use redigo default
+	}
+	return opts
+}
+
+// creates a function which dials a new connection to the address returned by the given function, and then prepares
+// it by authenticating and selecting the database
+func (c *poolConfig) dialer(address func(context.Context) (string, error)) func(context.Context) (redis.Conn, error) {
+	return func(ctx context.Context) (redis.Conn, error) {
+		addr, err := address(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := redis.DialContext(ctx, c.network, addr, c.dialOptions...)
 		if err != nil {
 			return nil, err
 		}
 
 		// send auth if required
-		if parsedURL.User != nil {
-			pass, authRequired := parsedURL.User.Password()
-			if authRequired {
-				if _, err := conn.Do("AUTH", pass); err != nil {
-					conn.Close()
-					return nil, err
-				}
+		if err := authenticate(ctx, conn, c.credentials); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if c.clientName != "" {
+			if _, err := redis.DoContext(conn, ctx, "CLIENT", "SETNAME", c.clientName); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("error setting client name: %w", err)
+			}
+
+			// older servers don't support SETINFO so ignore errors
+			conn.Send("CLIENT", "SETINFO", "LIB-NAME", libName)
+			conn.Send("CLIENT", "SETINFO", "LIB-VER", libVersion())
+			redis.DoContext(conn, ctx, "")
+		}
+
+		// switch to the right DB if it's not the default
+		if c.db != 0 {
+			if _, err := redis.DoContext(conn, ctx, "SELECT", c.db); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("error selecting database %d: %w", c.db, err)
 			}
 		}
 
-		// switch to the right DB
-		_, err = conn.Do("SELECT", strings.TrimLeft(parsedURL.Path, "/"))
-		return conn, err
+		return conn, nil
 	}
+}
 
+// creates a new pool which uses the given function to dial new connections
+func (c *poolConfig) pool(dial func(context.Context) (redis.Conn, error)) *redis.Pool {
 	rp := &redis.Pool{
-		MaxActive:   32,
-		MaxIdle:     4,
-		IdleTimeout: 180 * time.Second,
-		Wait:        true, // makes callers wait for a connection
-		Dial:        dial,
+		MaxActive:       c.maxActive,
+		MaxIdle:         c.maxIdle,
+		IdleTimeout:     c.idleTimeout,
+		MaxConnLifetime: c.maxLifetime,
+		Wait:            true, // makes callers wait for a connection
+		DialContext:     dial,
 	}
 
-	for _, o := range options {
-		o(rp)
+	if c.healthCheck {
+		rp.TestOnBorrow = func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < c.healthCheckIdle {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		}
 	}
 
-	// test the connection
+	return rp
+}
+
+// creates the pool returned to callers, with circuit breaking, retrying and hooks if they're configured
+func (c *poolConfig) build(dial func(context.Context) (redis.Conn, error)) *redis.Pool {
+	return c.instrument(c.pool(c.retrying(c.breaking(dial))))
+}
+
+// gets the version of this library from the build info of the binary it's part of
+func libVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == libModule {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == libModule {
+				return dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// applies any functions configured with WithPool to the given pool
+func (c *poolConfig) customize(rp *redis.Pool) {
+	for _, fn := range c.customizers {
+		fn(rp)
+	}
+}
+
+// tests that we can get a working connection from the given pool
+func checkPool(rp *redis.Pool) error {
 	conn := rp.Get()
 	defer conn.Close()
-	if _, err = conn.Do("PING"); err != nil {
-		return nil, err
+
+	_, err := conn.Do("PING")
+	return err
+}
+
+// doFunc sends a command on a connection, e.g. redis.DoContext, so that connection wrappers can implement both DoContext
+// and DoWithTimeout with the same logic
+type doFunc func(conn redis.Conn, ctx context.Context, cmd string, args ...any) (any, error)
+
+// gets a doFunc which sends commands with the given read timeout rather than using the context
+func doWithTimeout(timeout time.Duration) doFunc {
+	return func(conn redis.Conn, _ context.Context, cmd string, args ...any) (any, error) {
+		return redis.DoWithTimeout(conn, timeout, cmd, args...)
 	}
+}
 
-	return rp, nil
+// reads the database number from the path of a URL, which may be empty for the default database
+func (c *poolConfig) parsePath(path string) error {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+
+	db, err := strconv.Atoi(path)
+	if err != nil || db < 0 {
+		return fmt.Errorf("invalid database in URL path: %s", path)
+	}
+
+	c.db = db
+	return nil
+}
+
+// reads settings from the query parameters of a URL
+func (c *poolConfig) parseQuery(query url.Values) error {
+	for key, vals := range query {
+		val := vals[len(vals)-1]
+		var err error
+
+		switch key {
+		case "dial_timeout":
+			c.dialTimeout, err = parseDuration(val)
+		case "read_timeout":
+			c.readTimeout, err = parseDuration(val)
+		case "write_timeout":
+			c.writeTimeout, err = parseDuration(val)
+		case "idle_timeout":
+			c.idleTimeout, err = parseDuration(val)
+		case "max_active":
+			c.maxActive, err = strconv.Atoi(val)
+		case "max_idle":
+			c.maxIdle, err = strconv.Atoi(val)
+		case "db":
+			c.db, err = strconv.Atoi(val)
+			if err == nil && c.db < 0 {
+				err = errors.New("negative database")
+			}
+		case "client_name":
+			c.clientName = val
+		case "protocol":
+			if val != "2" {
+				return fmt.Errorf("unsupported protocol version: %s", val) // redigo only supports RESP2
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid value for URL parameter %s: %s", key, val)
+		}
+	}
+	return nil
+}
+
+// parses a duration which is either a number of seconds or a Go duration string like 500ms
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// credentials provider which returns the username and password in the given URL
+func urlCredentials(u *url.URL) CredentialsProvider {
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	return func(context.Context) (string, string, error) { return username, password, nil }
+}
+
+// authenticates a new connection using the given credentials, if they include a username or password
+func authenticate(ctx context.Context, conn redis.Conn, credentials CredentialsProvider) error {
+	username, password, err := credentials(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting credentials: %w", err)
+	}
+	if username == "" && password == "" {
+		return nil
+	}
+
+	if username != "" {
+		if _, err := redis.DoContext(conn, ctx, "AUTH", username, password); err != nil {
+			return fmt.Errorf("error authenticating as %s: %w", username, err)
+		}
+	} else {
+		if _, err := redis.DoContext(conn, ctx, "AUTH", password); err != nil {
+			return fmt.Errorf("error authenticating: %w", err)
+		}
+	}
+	return nil
+}
+
+// builds the TLS config from the TLS options, loading any CA bundle and client certificate
+func (c *poolConfig) tls() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+
+	if c.tlsCAFile != "" {
+		pem, err := os.ReadFile(c.tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.tlsCAFile)
+		}
+	}
+
+	if c.tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	if c.tlsServerName != "" {
+		tlsConfig.ServerName = c.tlsServerName
+	}
+
+	return tlsConfig, nil
 }
@@ -0,0 +1,193 @@
+package vkutil
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// readScript is a script which only reads, and so is run with EVALSHA_RO / EVAL_RO which replicas can serve
+type readScript struct {
+	src  string
+	hash string
+}
+
+func newReadScript(src string) *readScript {
+	h := sha1.Sum([]byte(src))
+	return &readScript{src: src, hash: hex.EncodeToString(h[:])}
+}
+
+// DoContext runs the script, loading it if it's not already cached on the server
+func (s *readScript) DoContext(ctx context.Context, rc redis.Conn, keysAndArgs ...any) (any, error) {
+	ctx = readOnly(ctx)
+
+	v, err := redis.DoContext(rc, ctx, "EVALSHA_RO", append([]any{s.hash}, keysAndArgs...)...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT ") {
+		v, err = redis.DoContext(rc, ctx, "EVAL_RO", append([]any{s.src}, keysAndArgs...)...)
+	}
+	return v, err
+}
+
+// WithReadReplicas configures replicas, given as URLs which are handled like the pool URL, to which read only
+// operations like IntervalSet.IsMember are sent. Everything else is sent to the primary. Each connection from the pool
+// dials its own connection to a replica when it first needs one, which is closed along with it. Only supported by
+// NewPool.
+func WithReadReplicas(urls ...string) PoolOption {
+	return func(c *poolConfig) { c.replicaURLs = urls }
+}
+
+// creates dialers for the configured replicas using the same options as the primary, and checks that we can connect
+func (c *poolConfig) replicas(options []PoolOption) (*replicaSet, error) {
+	rs := &replicaSet{}
+
+	for _, u := range c.replicaURLs {
+		rcfg, err := newPoolConfig(u, append(options[:len(options):len(options)], WithReadReplicas()))
+		if err != nil {
+			return nil, fmt.Errorf("error configuring replica: %w", err)
+		}
+
+		dial := rcfg.dialer(func(context.Context) (string, error) { return rcfg.address, nil })
+		if err := checkConn(dial); err != nil {
+			return nil, fmt.Errorf("error connecting to replica %s: %w", rcfg.address, err)
+		}
+
+		rs.dials = append(rs.dials, dial)
+	}
+	return rs, nil
+}
+
+// dials a connection with the given function and checks that the server responds
+func checkConn(dial func(context.Context) (redis.Conn, error)) error {
+	conn, err := dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PING")
+	return err
+}
+
+type replicaSet struct {
+	dials []func(context.Context) (redis.Conn, error)
+	next  atomic.Uint32
+}
+
+// dials a connection to the next replica
+func (s *replicaSet) dial(ctx context.Context) (redis.Conn, error) {
+	i := (s.next.Add(1) - 1) % uint32(len(s.dials))
+	return s.dials[i](ctx)
+}
+
+// wraps the given dial function so that connections send reads to replicas
+func (s *replicaSet) wrap(dial func(context.Context) (redis.Conn, error)) func(context.Context) (redis.Conn, error) {
+	return func(ctx context.Context) (redis.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &replicaConn{Conn: conn, replicas: s}, nil
+	}
+}
+
+// replicaConn is a connection to the primary which sends commands for reads to a replica, unless they're pipelined or
+// part of a transaction.
+type replicaConn struct {
+	redis.Conn // connection to the primary
+
+	replicas *replicaSet
+	replica  redis.Conn // connection to a replica, dialed when first needed
+	pending  int
+	multi    bool
+}
+
+func (c *replicaConn) Close() error {
+	if c.replica != nil {
+		c.replica.Close()
+		c.replica = nil
+	}
+	return c.Conn.Close()
+}
+
+func (c *replicaConn) Send(cmd string, args ...any) error {
+	c.pending++
+	c.track(cmd)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *replicaConn) Receive() (any, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *replicaConn) ReceiveContext(ctx context.Context) (any, error) {
+	if c.pending > 0 {
+		c.pending--
+	}
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func (c *replicaConn) ReceiveWithTimeout(timeout time.Duration) (any, error) {
+	if c.pending > 0 {
+		c.pending--
+	}
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+func (c *replicaConn) Do(cmd string, args ...any) (any, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *replicaConn) DoContext(ctx context.Context, cmd string, args ...any) (any, error) {
+	return c.do(ctx, redis.DoContext, cmd, args...)
+}
+
+func (c *replicaConn) DoWithTimeout(timeout time.Duration, cmd string, args ...any) (any, error) {
+	return c.do(context.Background(), doWithTimeout(timeout), cmd, args...)
+}
+
+func (c *replicaConn) do(ctx context.Context, do doFunc, cmd string, args ...any) (any, error) {
+	if cmd != "" && isReadOnly(ctx) && c.pending == 0 && !c.multi {
+		// if we can't get a replica connection, fall back to the primary
+		if replica, err := c.replicaConn(ctx); err == nil {
+			return do(replica, ctx, cmd, args...)
+		}
+	}
+
+	c.pending = 0
+	c.track(cmd)
+	return do(c.Conn, ctx, cmd, args...)
+}
+
+// gets our connection to a replica, dialing a new one if we don't have one or it's broken
+func (c *replicaConn) replicaConn(ctx context.Context) (redis.Conn, error) {
+	if c.replica != nil && c.replica.Err() == nil {
+		return c.replica, nil
+	}
+	if c.replica != nil {
+		c.replica.Close()
+		c.replica = nil
+	}
+
+	replica, err := c.replicas.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.replica = replica
+	return replica, nil
+}
+
+// tracks whether we're in a transaction
+func (c *replicaConn) track(cmd string) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.multi = true
+	case "EXEC", "DISCARD":
+		c.multi = false
+	}
+}
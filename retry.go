@@ -0,0 +1,163 @@
+package vkutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// error replies which mean the server can't serve commands right now, e.g. during a failover
+var transientErrors = []string{"LOADING ", "READONLY ", "TRYAGAIN ", "MASTERDOWN ", "CLUSTERDOWN "}
+
+type retryConfig struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// WithRetry configures connections to retry idempotent operations which fail with transient errors, e.g. a dropped
+// connection or a replica which is being promoted, on a new connection. Operations are attempted at most maxAttempts
+// times, waiting minBackoff before the first retry and doubling that up to maxBackoff for subsequent retries.
+func WithRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) PoolOption {
+	return func(c *poolConfig) {
+		c.retry = &retryConfig{maxAttempts: maxAttempts, minBackoff: minBackoff, maxBackoff: maxBackoff}
+	}
+}
+
+// wraps the given dial function so that connections retry idempotent operations, if retrying is configured
+func (c *poolConfig) retrying(dial func(context.Context) (redis.Conn, error)) func(context.Context) (redis.Conn, error) {
+	if c.retry == nil {
+		return dial
+	}
+
+	return func(ctx context.Context) (redis.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &retryConn{Conn: conn, dial: dial, cfg: c.retry}, nil
+	}
+}
+
+// retryConn is a connection which keeps the commands it has sent so that they can be sent again on a new connection
+// if they fail with a transient error
+type retryConn struct {
+	redis.Conn
+
+	dial    func(context.Context) (redis.Conn, error)
+	cfg     *retryConfig
+	pending []command
+}
+
+func (c *retryConn) Send(cmd string, args ...any) error {
+	c.pending = append(c.pending, command{name: cmd, args: args})
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *retryConn) Receive() (any, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *retryConn) ReceiveContext(ctx context.Context) (any, error) {
+	if len(c.pending) > 0 {
+		c.pending = c.pending[1:]
+	}
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func (c *retryConn) ReceiveWithTimeout(timeout time.Duration) (any, error) {
+	if len(c.pending) > 0 {
+		c.pending = c.pending[1:]
+	}
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
+
+func (c *retryConn) Do(cmd string, args ...any) (any, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *retryConn) DoContext(ctx context.Context, cmd string, args ...any) (any, error) {
+	return c.do(ctx, redis.DoContext, cmd, args...)
+}
+
+func (c *retryConn) DoWithTimeout(timeout time.Duration, cmd string, args ...any) (any, error) {
+	return c.do(context.Background(), doWithTimeout(timeout), cmd, args...)
+}
+
+func (c *retryConn) do(ctx context.Context, do doFunc, cmd string, args ...any) (any, error) {
+	cmds := c.pending
+	c.pending = nil
+	if cmd != "" {
+		cmds = append(cmds, command{name: cmd, args: args})
+	}
+
+	reply, err := do(c.Conn, ctx, cmd, args...)
+
+	if len(cmds) == 0 || !operation(ctx).idempotent {
+		return reply, err
+	}
+
+	backoff := c.cfg.minBackoff
+
+	for attempt := 1; attempt < c.cfg.maxAttempts && c.isTransient(ctx, err); attempt++ {
+		select {
+		case <-ctx.Done():
+			return reply, err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, c.cfg.maxBackoff)
+
+		reply, err = c.replay(ctx, do, cmd, cmds)
+	}
+
+	return reply, err
+}
+
+// sends the given commands again on a new connection, and if cmd is empty flushes them and returns all their replies
+func (c *retryConn) replay(ctx context.Context, do doFunc, cmd string, cmds []command) (any, error) {
+	// close the old connection before dialing so that this connection still only uses the one slot in the pool
+	c.Conn.Close()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err // keep the closed connection so that we know it's broken
+	}
+	c.Conn = conn
+
+	if cmd == "" {
+		for _, cm := range cmds {
+			conn.Send(cm.name, cm.args...)
+		}
+		return do(conn, ctx, "")
+	}
+
+	for _, cm := range cmds[:len(cmds)-1] {
+		conn.Send(cm.name, cm.args...)
+	}
+
+	last := cmds[len(cmds)-1]
+	return do(conn, ctx, last.name, last.args...)
+}
+
+// checks whether the given error is one that might not happen if we try again
+func (c *retryConn) isTransient(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if isConnectionFailure(c.Conn, err) || errors.Is(err, io.EOF) {
+		return true // connection is broken, which some wrappers like cluster connections don't report with Err
+	}
+
+	if rerr, ok := err.(redis.Error); ok {
+		for _, prefix := range transientErrors {
+			if strings.HasPrefix(string(rerr), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package vkutil_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+
+	// fake server which can be made to fail the next few commands
+	var mutex sync.Mutex
+	var received []string
+	var failures int
+	var failReply string
+
+	server := fakeServer(t, func(args []string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		cmd := strings.ToUpper(args[0])
+		if cmd == "PING" {
+			return "+PONG\r\n"
+		}
+
+		received = append(received, cmd)
+
+		if failures > 0 {
+			failures--
+			return failReply
+		}
+
+		switch cmd {
+		case "MULTI":
+			return "+OK\r\n"
+		case "HINCRBY", "HSET", "EXPIRE":
+			return "+QUEUED\r\n"
+		case "EXEC":
+			return "*2\r\n:1\r\n:1\r\n"
+		case "EVALSHA_RO":
+			return ":1\r\n"
+		case "GET":
+			return "$1\r\nx\r\n"
+		}
+		return "-ERR unexpected command\r\n"
+	})
+	fail := func(n int, reply string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		failures, failReply = n, reply
+	}
+	assertReceived := func(expected ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		assert.Equal(t, expected, received)
+		received = nil
+	}
+
+	rp, err := vkutil.NewPool("redis://"+server, vkutil.WithRetry(3, time.Millisecond, 2*time.Millisecond))
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	set := vkutil.NewIntervalSet("foos", time.Hour, 2)
+	series := vkutil.NewIntervalSeries("bars", time.Hour, 2)
+
+	// idempotent operation is retried when server is loading
+	fail(2, "-LOADING Valkey is loading the dataset in memory\r\n")
+
+	isMember, err := set.IsMember(ctx, rc, "A")
+	assert.NoError(t, err)
+	assert.True(t, isMember)
+	assertReceived("EVALSHA_RO", "EVALSHA_RO", "EVALSHA_RO")
+
+	// and when the connection is broken by a bad reply
+	fail(1, "?garbage\r\n")
+
+	isMember, err = set.IsMember(ctx, rc, "A")
+	assert.NoError(t, err)
+	assert.True(t, isMember)
+	assertReceived("EVALSHA_RO", "EVALSHA_RO")
+
+	// but only until we've made the max number of attempts
+	fail(3, "-READONLY You can't write against a read only replica.\r\n")
+
+	_, err = set.IsMember(ctx, rc, "A")
+	assert.EqualError(t, err, "READONLY You can't write against a read only replica.")
+	assertReceived("EVALSHA_RO", "EVALSHA_RO", "EVALSHA_RO")
+
+	// errors which aren't transient aren't retried
+	fail(1, "-ERR something went wrong\r\n")
+
+	_, err = set.IsMember(ctx, rc, "A")
+	assert.EqualError(t, err, "ERR something went wrong")
+	assertReceived("EVALSHA_RO")
+
+	// pipelined commands are sent again
+	fail(1, "-TRYAGAIN Multiple keys request during rehashing of slot\r\n")
+
+	assert.NoError(t, series.RecordGauge(ctx, rc, "A", 3))
+	assertReceived("MULTI", "HSET", "EXPIRE", "EXEC", "MULTI", "HSET", "EXPIRE", "EXEC")
+
+	// operations which aren't idempotent aren't retried
+	fail(1, "-LOADING Valkey is loading the dataset in memory\r\n")
+
+	err = series.Record(ctx, rc, "A", 1)
+	assert.EqualError(t, err, "LOADING Valkey is loading the dataset in memory")
+	assertReceived("MULTI", "HINCRBY", "EXPIRE", "EXEC")
+
+	// nor are commands unless they're marked as idempotent
+	fail(1, "-LOADING Valkey is loading the dataset in memory\r\n")
+
+	_, err = redis.DoContext(rc, ctx, "GET", "foo")
+	assert.EqualError(t, err, "LOADING Valkey is loading the dataset in memory")
+	assertReceived("GET")
+
+	fail(1, "-LOADING Valkey is loading the dataset in memory\r\n")
+
+	val, err := redis.String(redis.DoContext(rc, vkutil.Idempotent(ctx), "GET", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "x", val)
+	assertReceived("GET", "GET")
+
+	// flushing pipelined commands returns all their replies after a retry
+	fail(1, "?garbage\r\n")
+
+	rc.Send("GET", "foo")
+	rc.Send("GET", "bar")
+	replies, err := redis.Values(redis.DoContext(rc, vkutil.Idempotent(ctx), ""))
+	assert.NoError(t, err)
+	assert.Equal(t, []any{[]byte("x"), []byte("x")}, replies)
+	assertReceived("GET", "GET", "GET", "GET")
+
+	// commands can be sent with timeouts, though without a context they can't be marked as idempotent
+	val, err = redis.String(redis.DoWithTimeout(rc, time.Second, "GET", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "x", val)
+	assertReceived("GET")
+
+	// retrying stops if context is done
+	fail(3, "-LOADING Valkey is loading the dataset in memory\r\n")
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = set.IsMember(cctx, rc, "A")
+	assert.Error(t, err)
+	assertReceived()
+}
+
+func TestWithRetryCluster(t *testing.T) {
+	ctx := context.Background()
+
+	// fake cluster with a single node which drops the connection for the next few commands
+	var drops atomic.Int32
+	var port string
+
+	node := fakeServer(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			return "+PONG\r\n"
+		case "CLUSTER":
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$0\r\n\r\n:%s\r\n", port)
+		}
+		if drops.Add(-1) >= 0 {
+			return ""
+		}
+		return "$1\r\nx\r\n"
+	})
+	_, port, _ = net.SplitHostPort(node)
+
+	rp, err := vkutil.NewClusterPool("redis://"+node, vkutil.WithRetry(3, time.Millisecond, 2*time.Millisecond))
+	require.NoError(t, err)
+
+	rc := rp.Get()
+	defer rc.Close()
+
+	// idempotent command is retried when the connection to the node is dropped
+	drops.Store(1)
+
+	val, err := redis.String(redis.DoContext(rc, vkutil.Idempotent(ctx), "GET", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "x", val)
+
+	// but not more than the max number of attempts
+	drops.Store(3)
+
+	_, err = redis.DoContext(rc, vkutil.Idempotent(ctx), "GET", "foo")
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,141 @@
+package vkutil
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewSentinelPool creates a new pool which connects to the current primary of a master monitored by the given
+// Sentinel addresses. The host of the URL is the name of the master, e.g. redis://:password@mymaster/15, and the URL
+// is otherwise handled as it is by NewPool. The primary is discovered again whenever a new connection is dialed, and
+// connections are checked to still be connected to a primary when they are borrowed from the pool.
+func NewSentinelPool(redisURL string, sentinelAddrs []string, options ...PoolOption) (*redis.Pool, error) {
+	cfg, err := newPoolConfig(redisURL, options)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.network != "tcp" {
+		return nil, errors.New("sentinel pools can't use unix sockets")
+	}
+	if len(sentinelAddrs) == 0 {
+		return nil, errors.New("no sentinel addresses provided")
+	}
+	if len(cfg.replicaURLs) > 0 {
+		return nil, errors.New("sentinel pools don't support read replicas")
+	}
+
+	s := &sentinel{addrs: sentinelAddrs, masterName: cfg.address, dialOptions: cfg.sentinelTimeouts()}
+	dial := cfg.dialer(s.primary)
+
+	rp := cfg.build(func(ctx context.Context) (redis.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// sentinels may not yet know about a failover so check we really have the primary
+		if err := checkPrimary(ctx, conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+	rp.TestOnBorrow = func(conn redis.Conn, lastUsed time.Time) error {
+		return checkPrimary(context.Background(), conn) // also checks health so replaces any PING health check
+	}
+
+	cfg.customize(rp)
+
+	if err := checkPool(rp); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// timeout used for queries to sentinels when the pool doesn't configure one
+const sentinelTimeout = 5 * time.Second
+
+// gets the dial options for queries to sentinels, which always have timeouts so that a sentinel which doesn't answer
+// can't hold up dials
+func (c *poolConfig) sentinelTimeouts() []redis.DialOption {
+	return []redis.DialOption{
+		redis.DialConnectTimeout(cmp.Or(c.dialTimeout, sentinelTimeout)),
+		redis.DialReadTimeout(cmp.Or(c.readTimeout, sentinelTimeout)),
+		redis.DialWriteTimeout(cmp.Or(c.writeTimeout, sentinelTimeout)),
+	}
+}
+
+type sentinel struct {
+	addrs       []string
+	masterName  string
+	dialOptions []redis.DialOption
+
+	mutex sync.Mutex
+	last  int // index of the last sentinel which answered, which we ask first
+}
+
+// asks each sentinel in turn for the address of the current primary
+func (s *sentinel) primary(ctx context.Context) (string, error) {
+	s.mutex.Lock()
+	last := s.last
+	s.mutex.Unlock()
+
+	var lastErr error
+
+	for i := range s.addrs {
+		idx := (last + i) % len(s.addrs)
+
+		addr, err := s.ask(ctx, s.addrs[idx])
+		if err == nil {
+			s.mutex.Lock()
+			s.last = idx
+			s.mutex.Unlock()
+			return addr, nil
+		}
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("no sentinel provided the address of master %s: %w", s.masterName, lastErr)
+}
+
+func (s *sentinel) ask(ctx context.Context, sentinelAddr string) (string, error) {
+	conn, err := redis.DialContext(ctx, "tcp", sentinelAddr, s.dialOptions...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	hostAndPort, err := redis.Strings(redis.DoContext(conn, ctx, "SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err == redis.ErrNil {
+		return "", fmt.Errorf("sentinel %s doesn't know master %s", sentinelAddr, s.masterName)
+	} else if err != nil {
+		return "", err
+	}
+	if len(hostAndPort) != 2 {
+		return "", fmt.Errorf("sentinel %s returned unexpected master address %v", sentinelAddr, hostAndPort)
+	}
+
+	return net.JoinHostPort(hostAndPort[0], hostAndPort[1]), nil
+}
+
+// checks that the given connection is to a primary rather than a replica
+func checkPrimary(ctx context.Context, conn redis.Conn) error {
+	role, err := redis.Values(redis.DoContext(conn, ctx, "ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("empty reply to ROLE")
+	}
+	if r, _ := redis.String(role[0], nil); r != "master" {
+		return fmt.Errorf("connected to %s rather than primary", r)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package vkutil_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	vkutil "github.com/nyaruka/vkutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSentinelPool(t *testing.T) {
+	ctx := context.Background()
+
+	var master, nodeRole atomic.Value
+
+	// fake node whose role we can change
+	node := fakeServer(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "ROLE" {
+			role := nodeRole.Load().(string)
+			return fmt.Sprintf("*3\r\n$%d\r\n%s\r\n:0\r\n*0\r\n", len(role), role)
+		}
+		return "+OK\r\n"
+	})
+	nodeRole.Store("master")
+	master.Store(node)
+
+	// fake sentinel which knows about a single master called mymaster
+	sentinel := fakeServer(t, func(args []string) string {
+		if len(args) == 3 && strings.ToUpper(args[0]) == "SENTINEL" && args[1] == "get-master-addr-by-name" && args[2] == "mymaster" {
+			host, port, _ := net.SplitHostPort(master.Load().(string))
+			return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		}
+		return "*-1\r\n"
+	})
+
+	// first sentinel isn't running so second is used
+	rp, err := vkutil.NewSentinelPool("redis://mymaster/15", []string{"localhost:1", sentinel}, vkutil.WithMaxIdle(1))
+	require.NoError(t, err)
+
+	// simulate a failover where the node is now a replica.. borrowing the idle connection fails its role check and
+	// we dial a new connection which also fails because sentinel hasn't caught up
+	nodeRole.Store("slave")
+
+	rc := rp.Get()
+	_, err = redis.DoContext(rc, ctx, "PING")
+	assert.EqualError(t, err, "connected to slave rather than primary")
+	rc.Close()
+
+	// sentinel catches up and points at the new primary
+	master.Store("valkey8:6379")
+
+	rc = rp.Get()
+	_, err = redis.DoContext(rc, ctx, "SET", "test_sentinel", "1")
+	assert.NoError(t, err)
+	rc.Close()
+
+	c, err := redis.Dial("tcp", "valkey8:6379", redis.DialDatabase(15))
+	require.NoError(t, err)
+	defer c.Close()
+
+	val, err := redis.String(redis.DoContext(c, ctx, "GETDEL", "test_sentinel"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", val)
+
+	// sentinel which accepts connections but never answers is given up on even without configured timeouts
+	hung := make(chan struct{})
+	defer close(hung)
+	unresponsive := fakeServer(t, func(args []string) string {
+		<-hung
+		return ""
+	})
+
+	start := time.Now()
+	rp, err = vkutil.NewSentinelPool("redis://mymaster/15", []string{unresponsive, sentinel})
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	rc = rp.Get()
+	_, err = redis.DoContext(rc, ctx, "PING")
+	assert.NoError(t, err)
+	rc.Close()
+
+	_, err = vkutil.NewSentinelPool("redis://othermaster/15", []string{sentinel})
+	assert.ErrorContains(t, err, "no sentinel provided the address of master othermaster: sentinel 127.0.0.1:")
+	assert.ErrorContains(t, err, "doesn't know master othermaster")
+
+	_, err = vkutil.NewSentinelPool("redis://mymaster/15", nil)
+	assert.EqualError(t, err, "no sentinel addresses provided")
+
+	_, err = vkutil.NewSentinelPool("unix:///var/run/valkey.sock", []string{sentinel})
+	assert.EqualError(t, err, "sentinel pools can't use unix sockets")
+
+	_, err = vkutil.NewSentinelPool("redis://mymaster/15", []string{"localhost:1"}, vkutil.WithReadReplicas("redis://localhost:1/15"))
+	assert.EqualError(t, err, "sentinel pools don't support read replicas")
+}
+
+// starts a fake server which replies to each command with the raw RESP returned by the given handler
+func fakeServer(t *testing.T, handler func(args []string) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					reply := handler(args)
+					if reply == "" {
+						return // drop the connection
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// reads a command sent as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	line, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	args := make([]string, n)
+
+	for i := range args {
+		line, err := readLine() // $<length>
+		if err != nil {
+			return nil, err
+		}
+		length, _ := strconv.Atoi(strings.TrimPrefix(line, "$"))
+
+		arg := make([]byte, length+2) // includes \r\n
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:length])
+	}
+	return args, nil
+}
@@ -48,12 +48,48 @@ func intervalTimestamp(t time.Time, interval time.Duration) string {
 	return t.Format("2006-01-02")
 }
 
+// intervalStarts returns the start times of the given number of intervals, newest first
+func intervalStarts(now time.Time, interval time.Duration, size int) []time.Time {
+	starts := make([]time.Time, size)
+	for i := range starts {
+		starts[i] = now.Add(-interval * time.Duration(i)).UTC().Truncate(interval)
+	}
+	return starts
+}
+
+// IntervalOption is an option passed to the constructors of interval based types
+type IntervalOption func(*intervalOptions)
+
+type intervalOptions struct {
+	hashTag bool
+}
+
+// WithHashTag wraps the key base in a hash tag, e.g. {foo}:2024-01-01, so that all intervals are stored in the same
+// cluster slot. Without it, keys are named as they always have been, e.g. foo:2024-01-01.
+func WithHashTag() IntervalOption {
+	return func(o *intervalOptions) { o.hashTag = true }
+}
+
+// applies the given options to a key base
+func intervalKeyBase(keyBase string, options []IntervalOption) string {
+	o := &intervalOptions{}
+	for _, opt := range options {
+		opt(o)
+	}
+	if o.hashTag {
+		return "{" + keyBase + "}"
+	}
+	return keyBase
+}
+
+func intervalKey(keyBase string, t time.Time, interval time.Duration) string {
+	return fmt.Sprintf("%s:%s", keyBase, intervalTimestamp(t, interval))
+}
+
 func intervalKeys(keyBase string, interval time.Duration, size int) []string {
-	now := dates.Now()
 	keys := make([]string, size)
-	for i := range keys {
-		timestamp := intervalTimestamp(now.Add(-interval*time.Duration(i)), interval)
-		keys[i] = fmt.Sprintf("%s:%s", keyBase, timestamp)
+	for i, start := range intervalStarts(dates.Now(), interval, size) {
+		keys[i] = intervalKey(keyBase, start, interval)
 	}
 	return keys
 }